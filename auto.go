@@ -0,0 +1,98 @@
+package xenstore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DialAttempt records one of the Transports tried by DialAuto.
+type DialAttempt struct {
+	// Kind is the type of Transport, such as "socket" or "xenbus".
+	Kind string
+	// Path is the socket or device which was opened.
+	Path string
+	// Err is the reason the Transport could not be opened, or nil if it was used.
+	Err error
+}
+
+func (a DialAttempt) String() string {
+	if a.Err == nil {
+		return fmt.Sprintf("%s %s: ok", a.Kind, a.Path)
+	}
+
+	return fmt.Sprintf("%s %s: %s", a.Kind, a.Path, a.Err)
+}
+
+// AutoDialError is returned by DialAuto when none of the Transports could be opened.
+type AutoDialError struct {
+	Attempts []DialAttempt
+}
+
+func (e *AutoDialError) Error() string {
+	attempts := make([]string, len(e.Attempts))
+	for i, attempt := range e.Attempts {
+		attempts[i] = attempt.String()
+	}
+
+	return "no XenStore transport available (" + strings.Join(attempts, "; ") + ")"
+}
+
+// Unwrap returns the errors of all of the attempts, so that errors.Is can be used to
+// check for causes such as fs.ErrNotExist.
+func (e *AutoDialError) Unwrap() []error {
+	errs := make([]error, len(e.Attempts))
+	for i, attempt := range e.Attempts {
+		errs[i] = attempt.Err
+	}
+
+	return errs
+}
+
+// autoTransport is a Transport which DialAuto may try.
+type autoTransport struct {
+	kind string
+	path string
+	dial func() (Transport, error)
+}
+
+// DialAuto opens a Transport to the XenStore of the local system, trying each of the
+// ways of reaching it in turn. On Linux & other Unix systems that is the unix socket
+// at UnixSocketPath, which is only present in the domain running xenstored, followed
+// by the XenBus device at XenBusPath and then /dev/xen/xenbus. On Windows the WinPV
+// drivers are used.
+//
+// The attempts made are returned in order, with the one which succeeded last, so
+// that callers can report which Transport was chosen & why the others failed. If none
+// succeed then the error is an *AutoDialError listing all of the attempts.
+func DialAuto() (Transport, []DialAttempt, error) {
+	var attempts []DialAttempt
+
+	for _, candidate := range autoTransports() {
+		t, err := candidate.dial()
+		attempts = append(attempts, DialAttempt{Kind: candidate.kind, Path: candidate.path, Err: err})
+
+		if err == nil {
+			return t, attempts, nil
+		}
+	}
+
+	return nil, attempts, &AutoDialError{Attempts: attempts}
+}
+
+// NewDefaultClient creates a new Client connected to the XenStore of the local system
+// using DialAuto. The Transport which was chosen is reported to the Client's Logger at
+// debug level.
+func NewDefaultClient(opts ...ClientOption) (*Client, error) {
+	t, attempts, err := DialAuto()
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewClient(t, opts...)
+
+	for _, attempt := range attempts {
+		c.opts.logger.Debugf("connecting to XenStore using %s", attempt)
+	}
+
+	return c, nil
+}
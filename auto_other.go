@@ -0,0 +1,28 @@
+//go:build !windows
+
+package xenstore
+
+func autoTransports() []autoTransport {
+	candidates := []autoTransport{
+		{
+			kind: "socket",
+			path: UnixSocketPath(),
+			dial: func() (Transport, error) { return NewUnixSocketTransport(UnixSocketPath()) },
+		},
+	}
+
+	for _, path := range []string{XenBusPath(), "/dev/xen/xenbus"} {
+		if path == candidates[len(candidates)-1].path {
+			continue
+		}
+
+		path := path
+		candidates = append(candidates, autoTransport{
+			kind: "xenbus",
+			path: path,
+			dial: func() (Transport, error) { return NewXenBusTransport(path) },
+		})
+	}
+
+	return candidates
+}
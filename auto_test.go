@@ -0,0 +1,68 @@
+package xenstore
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialAutoSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("DialAuto uses the WinPV drivers on Windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "socket")
+	t.Setenv("XENSTORED_PATH", path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	tr, attempts, err := DialAuto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	assert.IsType(t, &UnixSocketTransport{}, tr)
+	assert.Equal(t, []DialAttempt{{Kind: "socket", Path: path}}, attempts)
+}
+
+func TestDialAutoFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("DialAuto uses the WinPV drivers on Windows")
+	}
+
+	for _, path := range []string{XenBusPath(), "/dev/xen/xenbus"} {
+		if _, err := os.Stat(path); err == nil {
+			t.Skipf("%s exists on this system", path)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "missing")
+	t.Setenv("XENSTORED_PATH", path)
+
+	_, attempts, err := DialAuto()
+
+	var autoErr *AutoDialError
+	if !errors.As(err, &autoErr) {
+		t.Fatalf("expected an *AutoDialError, got %v", err)
+	}
+
+	assert.Equal(t, attempts, autoErr.Attempts)
+	assert.Equal(t, "socket", attempts[0].Kind)
+	assert.Equal(t, path, attempts[0].Path)
+	assert.Equal(t, "xenbus", attempts[len(attempts)-1].Kind)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	_, err = NewDefaultClient()
+	assert.Error(t, err)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package xenstore
+
+func autoTransports() []autoTransport {
+	return []autoTransport{
+		{
+			kind: "winpv",
+			path: SessionName,
+			dial: func() (Transport, error) { return NewWinPVTransport() },
+		},
+	}
+}
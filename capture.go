@@ -0,0 +1,238 @@
+package xenstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// captureMagic begins every capture file, followed by the little endian uint16
+// captureVersion.
+const (
+	captureMagic   = "XSCAP\x00"
+	captureVersion = 1
+)
+
+// captureRecordHeaderSize is the size of the fields written before each Packet in a
+// capture: the time in nanoseconds since the Unix epoch as a little endian int64, the
+// direction & 3 bytes of padding.
+const captureRecordHeaderSize = 12
+
+// ErrBadCapture is returned when reading a capture which was not written by a
+// CaptureWriter or uses an unsupported version of the format.
+var ErrBadCapture = errors.New("not a xenstore capture")
+
+// CaptureDirection is the direction in which a captured Packet travelled.
+type CaptureDirection uint8
+
+const (
+	// CaptureSent is a request sent to XenStore.
+	CaptureSent CaptureDirection = iota + 1
+	// CaptureReceived is a reply or watch event received from XenStore.
+	CaptureReceived
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureSent:
+		return "send"
+	case CaptureReceived:
+		return "receive"
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(d))
+}
+
+// CaptureRecord is a single Packet in a capture.
+type CaptureRecord struct {
+	Time      time.Time
+	Direction CaptureDirection
+	Packet    *Packet
+}
+
+// CaptureWriter writes a capture: a short header followed by a timestamped record for
+// each Packet, which holds the Packet exactly as it is sent to XenStore. It is safe
+// for concurrent use.
+type CaptureWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewCaptureWriter writes the capture header to w & returns a CaptureWriter for adding
+// records to it.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	header := make([]byte, len(captureMagic)+2)
+	copy(header, captureMagic)
+	binary.LittleEndian.PutUint16(header[len(captureMagic):], captureVersion)
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &CaptureWriter{w: w}, nil
+}
+
+// Write adds rec to the capture using a single call to Write on the underlying writer.
+func (cw *CaptureWriter) Write(rec *CaptureRecord) error {
+	p := rec.Packet
+
+	buf := make([]byte, captureRecordHeaderSize+int(PacketHeaderSize)+len(p.Payload))
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(rec.Time.UnixNano()))
+	buf[8] = byte(rec.Direction)
+
+	// The header is copied so that Length can be set without modifying the Packet
+	header := *p.Header
+	header.Length = uint32(len(p.Payload))
+	header.put(buf[captureRecordHeaderSize:])
+	copy(buf[captureRecordHeaderSize+int(PacketHeaderSize):], p.Payload)
+
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	_, err := cw.w.Write(buf)
+	return err
+}
+
+// CaptureReader reads the records from a capture written by a CaptureWriter.
+type CaptureReader struct {
+	r io.Reader
+}
+
+// NewCaptureReader checks the capture header at the start of r & returns a
+// CaptureReader for reading the records which follow it.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	header := make([]byte, len(captureMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrBadCapture
+		}
+		return nil, err
+	}
+
+	if string(header[:len(captureMagic)]) != captureMagic {
+		return nil, ErrBadCapture
+	}
+
+	if version := binary.LittleEndian.Uint16(header[len(captureMagic):]); version != captureVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadCapture, version)
+	}
+
+	return &CaptureReader{r: r}, nil
+}
+
+// Next returns the next record, or io.EOF once all of them have been read. A capture
+// which ends part of the way through a record, e.g. because the program writing it was
+// killed, returns io.ErrUnexpectedEOF.
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	buf := make([]byte, captureRecordHeaderSize)
+	if _, err := io.ReadFull(cr.r, buf); err != nil {
+		return nil, err
+	}
+
+	rec := &CaptureRecord{
+		Time:      time.Unix(0, int64(binary.LittleEndian.Uint64(buf[0:8]))),
+		Direction: CaptureDirection(buf[8]),
+		Packet:    &Packet{},
+	}
+
+	if rec.Direction != CaptureSent && rec.Direction != CaptureReceived {
+		return nil, fmt.Errorf("%w: unknown direction %d", ErrBadCapture, buf[8])
+	}
+
+	if err := rec.Packet.Unpack(cr.r); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// ReadCapture reads all of the records from a capture.
+func ReadCapture(r io.Reader) ([]*CaptureRecord, error) {
+	cr, err := NewCaptureReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*CaptureRecord
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+
+		records = append(records, rec)
+	}
+}
+
+// TapTransport is a Transport which wraps another, writing every Packet sent or
+// received to a capture, much like tcpdump. Failing to write the capture does not
+// affect the connection to XenStore: the first error is kept & returned by Err.
+type TapTransport struct {
+	Transport
+
+	capture *CaptureWriter
+
+	lock sync.Mutex
+	err  error
+}
+
+// NewTapTransport creates a TapTransport which captures the Packets of t to capture.
+func NewTapTransport(t Transport, capture *CaptureWriter) *TapTransport {
+	return &TapTransport{
+		Transport: t,
+		capture:   capture,
+	}
+}
+
+func (t *TapTransport) record(dir CaptureDirection, p *Packet) {
+	err := t.capture.Write(&CaptureRecord{
+		Time:      time.Now(),
+		Direction: dir,
+		Packet:    p,
+	})
+	if err == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// Send captures p & sends it using the wrapped Transport.
+func (t *TapTransport) Send(p *Packet) error {
+	// Captured first as the reply may be received before Send returns
+	t.record(CaptureSent, p)
+
+	return t.Transport.Send(p)
+}
+
+// Receive receives a Packet using the wrapped Transport & captures it.
+func (t *TapTransport) Receive() (*Packet, error) {
+	p, err := t.Transport.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	t.record(CaptureReceived, p)
+	return p, nil
+}
+
+// Err returns the first error from writing the capture, if any.
+func (t *TapTransport) Err() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.err
+}
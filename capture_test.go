@@ -0,0 +1,97 @@
+package xenstore_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTapTransport(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	var buf bytes.Buffer
+	capture, err := NewCaptureWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tap := NewTapTransport(store.Connect(), capture)
+	c := NewClient(tap)
+
+	_, err = c.Write("/test", "value")
+	assert.NoError(t, err)
+
+	_, err = c.Read("/missing")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	assert.NoError(t, c.Close())
+	assert.NoError(t, tap.Err())
+
+	records, err := ReadCapture(&buf)
+	assert.NoError(t, err)
+
+	if !assert.Len(t, records, 4) {
+		return
+	}
+
+	for i, expected := range []struct {
+		dir     CaptureDirection
+		op      Operation
+		payload []string
+	}{
+		{CaptureSent, XsWrite, []string{"/test", "value"}},
+		{CaptureReceived, XsWrite, []string{"OK"}},
+		{CaptureSent, XsRead, []string{"/missing"}},
+		{CaptureReceived, XsError, []string{"ENOENT"}},
+	} {
+		rec := records[i]
+		assert.Equal(t, expected.dir, rec.Direction)
+		assert.Equal(t, expected.op, rec.Packet.Header.Op)
+		assert.Equal(t, expected.payload, rec.Packet.Strings())
+		assert.False(t, rec.Time.IsZero())
+	}
+
+	// Replies carry the ID of their request
+	assert.Equal(t, records[0].Packet.Header.RqId, records[1].Packet.Header.RqId)
+	assert.False(t, records[1].Time.Before(records[0].Time))
+}
+
+func TestReadCaptureTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	capture, err := NewCaptureWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		p, err := NewPacket(XsRead, []byte("/test\x00"), 0x0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NoError(t, capture.Write(&CaptureRecord{Direction: CaptureSent, Packet: p}))
+	}
+
+	records, err := ReadCapture(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Len(t, records, 1)
+}
+
+func TestReadCaptureInvalid(t *testing.T) {
+	for name, input := range map[string][]byte{
+		"empty":     {},
+		"magic":     []byte("NOTACAPTURE"),
+		"version":   []byte("XSCAP\x00\x02\x00"),
+		"direction": append([]byte("XSCAP\x00\x01\x00"), make([]byte, CaptureRecordHeaderSize)...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ReadCapture(bytes.NewReader(input))
+			assert.True(t, errors.Is(err, ErrBadCapture), err)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package xenstore
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConflict is wrapped by a ConflictError, so that errors.Is can be used to check
+// whether CompareAndSwap or CreateIfAbsent failed because of the current value.
+var ErrConflict = errors.New("value does not match")
+
+// ConflictError is returned by CompareAndSwap & CreateIfAbsent when the current
+// value of the path is not the one required to make the change.
+type ConflictError struct {
+	Path string
+	// Current & Exists describe the path at the time of the check.
+	Current string
+	Exists  bool
+}
+
+func (e *ConflictError) Error() string {
+	if !e.Exists {
+		return fmt.Sprintf("%s: %s: path does not exist", e.Path, ErrConflict)
+	}
+
+	return fmt.Sprintf("%s: %s: current value is %q", e.Path, ErrConflict, e.Current)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// CompareAndSwap writes new to path only if its current value is old, using a
+// transaction so that nothing can change path between the check & the write. The
+// transaction is retried if it conflicts with another change. If path does not exist
+// or has a different value then a *ConflictError describing it is returned.
+func (c *Client) CompareAndSwap(path, old, new string) error {
+	return c.Transact(func(tx *Transaction) error {
+		return tx.compareAndSwap(path, old, true, new)
+	})
+}
+
+// CreateIfAbsent writes value to path only if path does not already exist, using a
+// transaction so that nothing can create path between the check & the write. The
+// transaction is retried if it conflicts with another change. If path already exists
+// then a *ConflictError describing it is returned.
+func (c *Client) CreateIfAbsent(path, value string) error {
+	return c.Transact(func(tx *Transaction) error {
+		return tx.compareAndSwap(path, "", false, value)
+	})
+}
+
+// compareAndSwap writes new to path if its current state matches old & exists.
+func (t *Transaction) compareAndSwap(path, old string, exists bool, new string) error {
+	current, err := t.Read(path)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		if exists {
+			return &ConflictError{Path: path}
+		}
+	case err != nil:
+		return err
+	case !exists || current != old:
+		return &ConflictError{Path: path, Current: current, Exists: true}
+	}
+
+	_, err = t.Write(path, new)
+	return err
+}
@@ -0,0 +1,96 @@
+package xenstore_test
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCompareAndSwap(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	err := c.CompareAndSwap("/test/value", "", "1")
+	assert.True(t, errors.Is(err, ErrConflict))
+	assert.Equal(t, &ConflictError{Path: "/test/value"}, err)
+
+	if _, err := c.Write("/test/value", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.CompareAndSwap("/test/value", "2", "3")
+	assert.Equal(t, &ConflictError{Path: "/test/value", Current: "1", Exists: true}, err)
+
+	assert.NoError(t, c.CompareAndSwap("/test/value", "1", "2"))
+
+	val, err := c.Read("/test/value")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", val)
+}
+
+func TestClientCreateIfAbsent(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	assert.NoError(t, c.CreateIfAbsent("/test/lock", "owner1"))
+
+	err := c.CreateIfAbsent("/test/lock", "owner2")
+	assert.True(t, errors.Is(err, ErrConflict))
+	assert.Equal(t, &ConflictError{Path: "/test/lock", Current: "owner1", Exists: true}, err)
+
+	val, err := c.Read("/test/lock")
+	assert.NoError(t, err)
+	assert.Equal(t, "owner1", val)
+}
+
+func TestClientCompareAndSwapConcurrent(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	setup := store.Client()
+	defer setup.Close()
+
+	if _, err := setup.Write("/test/counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, increments = 4, 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := store.Client()
+			defer c.Close()
+
+			for done := 0; done < increments; {
+				val, err := c.Read("/test/counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				n, _ := strconv.Atoi(val)
+				err = c.CompareAndSwap("/test/counter", val, strconv.Itoa(n+1))
+				switch {
+				case err == nil:
+					done++
+				case !errors.Is(err, ErrConflict) && !errors.Is(err, ErrTransactionConflict):
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := setup.Read("/test/counter")
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(workers*increments), val)
+}
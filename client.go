@@ -2,51 +2,70 @@ package xenstore
 
 import (
 	"bytes"
+	"context"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Client is a wrapper which allows easier communication with XenStore by providing
 // methods which allow performing normal XenStore functions with minimal effort.
 type Client struct {
-	transport Transport
 	router    *Router
+	opts      clientOptions
+	done      chan struct{}
 	stopError error
 }
 
 // NewUnixSocketClient creates a new Client which will be connected to an underlying
 // UnixSocket.
-func NewUnixSocketClient(path string) (*Client, error) {
+func NewUnixSocketClient(path string, opts ...ClientOption) (*Client, error) {
 	t, err := NewUnixSocketTransport(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewClient(t), nil
+	return NewClient(t, opts...), nil
 }
 
 // NewXenBusClient creates a new Client which will be connected to an underlying
 // XenBus device.
-func NewXenBusClient(path string) (*Client, error) {
+func NewXenBusClient(path string, opts ...ClientOption) (*Client, error) {
 	t, err := NewXenBusTransport(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewClient(t), nil
+	return NewClient(t, opts...), nil
 }
 
 // NewClient creates a new connected Client and starts the internal Router so
 // that packets can be sent and received correctly by the Client.
-func NewClient(t Transport) *Client {
+func NewClient(t Transport, opts ...ClientOption) *Client {
+	o := defaultClientOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	r := NewRouter(t)
+	r.watchBufferSize = o.watchBufferSize
+	r.orphanHandler = o.orphanHandler
+	r.logger = o.logger
+	r.reconnect = o.reconnect
+	if o.observer != nil {
+		r.SetObserver(o.observer)
+	}
+
 	c := &Client{
-		transport: t,
-		router:    NewRouter(t),
+		router: r,
+		opts:   o,
+		done:   make(chan struct{}),
 	}
 
 	// Run router in separate goroutine
 	go func() {
 		c.stopError = c.router.Start()
+		close(c.done)
 	}()
 
 	return c
@@ -55,52 +74,141 @@ func NewClient(t Transport) *Client {
 // Close stops the underlying Router and closes the Transport.
 func (c *Client) Close() error {
 	c.router.Stop()
-	return c.transport.Close()
+	return c.router.currentTransport().Close()
+}
+
+// SetObserver sets an Observer which will be notified about all of the requests,
+// replies and watch events handled by the Client.
+func (c *Client) SetObserver(o Observer) {
+	c.router.SetObserver(o)
+}
+
+// Done returns a channel which is closed once the internal Router has stopped, after
+// which no further requests can be made using the Client.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
 }
 
+// Error returns the error which caused the internal Router to stop, or nil if it is
+// still running or stopped cleanly.
 func (c *Client) Error() error {
-	return c.stopError
+	select {
+	case <-c.done:
+		return c.stopError
+	default:
+		return nil
+	}
 }
 
 // submitBytes submits a Packet to XenStore and reads a Packet in reply. The response packet
 // is checked for errors which are returned from XenStore as strings.
 //
 // This method blocks until the reply packet is received.
-func (c *Client) submitBytes(op xenStoreOperation, payload []byte, txid uint32) (*Packet, error) {
-	p, err := NewPacket(op, []byte(payload), 0x0)
+func (c *Client) submitBytes(op Operation, payload []byte, txid uint32) (*Packet, error) {
+	p, ch, err := c.sendBytes(op, payload, txid)
 	if err != nil {
 		return nil, err
 	}
 
+	return c.waitReply(p, ch)
+}
+
+// sendBytes submits a Packet to XenStore without waiting for the reply, returning the
+// request Packet and the channel the reply will be delivered on.
+func (c *Client) sendBytes(op Operation, payload []byte, txid uint32) (*Packet, chan *Packet, error) {
+	p, err := NewPacket(op, []byte(payload), txid)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	ch, err := c.router.Send(p)
 	if err != nil {
-		return nil, err
+		return nil, nil, opError(p, err)
 	}
 
-	rsp := <-ch
+	return p, ch, nil
+}
+
+// waitReply waits for the reply to the request p to be delivered on ch, applying the
+// request timeout. Failures are returned as an *OpError.
+func (c *Client) waitReply(p *Packet, ch chan *Packet) (*Packet, error) {
+	return c.awaitReply(context.Background(), p, ch, nil, nil)
+}
+
+// awaitReply is waitReply but also passes any packets received on events to onEvent
+// while waiting, so that the Router is never blocked delivering watch events to a
+// caller which is waiting for a reply. It gives up early if ctx is done.
+func (c *Client) awaitReply(ctx context.Context, p *Packet, ch chan *Packet, events chan *Packet, onEvent func(*Packet, bool)) (*Packet, error) {
+	var timeout <-chan time.Time
+	if c.opts.requestTimeout > 0 {
+		timer := time.NewTimer(c.opts.requestTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var rsp *Packet
+	var ok bool
+
+WAIT:
+	for {
+		select {
+		case rsp, ok = <-ch:
+			if !ok {
+				return nil, opError(p, ErrConnectionLost)
+			}
+			break WAIT
+		case event, ok := <-events:
+			if !ok {
+				// The watch has been removed, or the Client is shutting down & ch
+				// will be closed too
+				events = nil
+			}
+			onEvent(event, ok)
+		case <-timeout:
+			c.router.cancel(p.Header.RqId)
+			return nil, opError(p, ErrRequestTimeout)
+		case <-ctx.Done():
+			c.router.cancel(p.Header.RqId)
+			return nil, ctx.Err()
+		}
+	}
 
 	if rsp.Header.Op == XsError {
 		trimmed := strings.Trim(string(rsp.Payload), "\x00")
-		return nil, Error(trimmed)
+		return nil, opError(p, Error(trimmed))
 	}
 
 	return rsp, nil
 }
 
-// List lists the descendants of path.
+// List lists the children of path. A path with no children gives an empty slice
+// rather than a slice holding a single empty name.
 func (c *Client) List(path string) ([]string, error) {
-	p, err := c.submitBytes(XsDirectory, append([]byte(path), NUL), 0x0)
+	return c.list(path, 0x0)
+}
+
+func (c *Client) list(path string, txid uint32) ([]string, error) {
+	p, err := c.submitBytes(XsDirectory, append([]byte(path), NUL), txid)
 	if err != nil {
 		return []string{}, err
 	}
 
 	// Contents are delimited by NUL bytes
-	return strings.Split(p.payloadString(), "\x00"), nil
+	payload := p.payloadString()
+	if payload == "" {
+		return []string{}, nil
+	}
+
+	return strings.Split(payload, "\x00"), nil
 }
 
 // Read reads the contents of path from XenStore.
 func (c *Client) Read(path string) (string, error) {
-	p, err := c.submitBytes(XsRead, append([]byte(path), NUL), 0x0)
+	return c.read(path, 0x0)
+}
+
+func (c *Client) read(path string, txid uint32) (string, error) {
+	p, err := c.submitBytes(XsRead, append([]byte(path), NUL), txid)
 	if err != nil {
 		return "", err
 	}
@@ -108,9 +216,61 @@ func (c *Client) Read(path string) (string, error) {
 	return p.payloadString(), nil
 }
 
+// ReadMany reads the contents of all of paths from XenStore. All of the requests are
+// sent before waiting for any of the replies so this is much faster than calling Read
+// for each path in turn. The values which were read successfully are returned in the
+// first map and any errors, keyed by path, in the second.
+//
+// The values are read independently of each other; use Transaction.ReadMany (for
+// example from within Client.Transact) to read a consistent set of values.
+func (c *Client) ReadMany(paths []string) (map[string]string, map[string]error) {
+	return c.readMany(paths, 0x0)
+}
+
+func (c *Client) readMany(paths []string, txid uint32) (map[string]string, map[string]error) {
+	type request struct {
+		pkt *Packet
+		ch  chan *Packet
+	}
+
+	values := map[string]string{}
+	errs := map[string]error{}
+	requests := map[string]request{}
+
+	for _, path := range paths {
+		if _, ok := requests[path]; ok {
+			continue
+		}
+
+		p, ch, err := c.sendBytes(XsRead, append([]byte(path), NUL), txid)
+		if err != nil {
+			errs[path] = err
+			continue
+		}
+
+		requests[path] = request{p, ch}
+	}
+
+	for path, req := range requests {
+		rsp, err := c.waitReply(req.pkt, req.ch)
+		if err != nil {
+			errs[path] = err
+			continue
+		}
+
+		values[path] = rsp.payloadString()
+	}
+
+	return values, errs
+}
+
 // Remove removes a path from XenStore recursively
 func (c *Client) Remove(path string) (string, error) {
-	p, err := c.submitBytes(XsRm, append([]byte(path), NUL), 0x0)
+	return c.remove(path, 0x0)
+}
+
+func (c *Client) remove(path string, txid uint32) (string, error) {
+	p, err := c.submitBytes(XsRm, append([]byte(path), NUL), txid)
 	if err != nil {
 		return "", err
 	}
@@ -120,11 +280,15 @@ func (c *Client) Remove(path string) (string, error) {
 
 // Write value to XenStore at path.
 func (c *Client) Write(path, value string) (string, error) {
+	return c.write(path, value, 0x0)
+}
+
+func (c *Client) write(path, value string, txid uint32) (string, error) {
 	buf := bytes.NewBufferString(path)
 	buf.WriteByte(NUL)
 	buf.WriteString(value)
 
-	p, err := c.submitBytes(XsWrite, buf.Bytes(), 0x0)
+	p, err := c.submitBytes(XsWrite, buf.Bytes(), txid)
 	if err != nil {
 		return "", err
 	}
@@ -134,7 +298,11 @@ func (c *Client) Write(path, value string) (string, error) {
 
 // GetPermissions returns the currently stored permissions for a XenStore path.
 func (c *Client) GetPermissions(path string) (string, error) {
-	p, err := c.submitBytes(XsGetPermissions, append([]byte(path), NUL), 0x0)
+	return c.getPermissions(path, 0x0)
+}
+
+func (c *Client) getPermissions(path string, txid uint32) (string, error) {
+	p, err := c.submitBytes(XsGetPermissions, append([]byte(path), NUL), txid)
 	if err != nil {
 		return "", err
 	}
@@ -144,6 +312,10 @@ func (c *Client) GetPermissions(path string) (string, error) {
 
 // SetPermissions sets the permissions for a path in XenStore.
 func (c *Client) SetPermissions(path string, perms []string) (string, error) {
+	return c.setPermissions(path, perms, 0x0)
+}
+
+func (c *Client) setPermissions(path string, perms []string, txid uint32) (string, error) {
 	buf := bytes.NewBufferString(path)
 	for _, perm := range perms {
 		buf.WriteByte(NUL)
@@ -151,7 +323,7 @@ func (c *Client) SetPermissions(path string, perms []string) (string, error) {
 	}
 	buf.WriteByte(NUL)
 
-	p, err := c.submitBytes(XsSetPermissions, buf.Bytes(), 0x0)
+	p, err := c.submitBytes(XsSetPermissions, buf.Bytes(), txid)
 	if err != nil {
 		return "", err
 	}
@@ -171,7 +343,9 @@ func (c *Client) GetDomainPath(domid int) (string, error) {
 	return p.payloadString(), nil
 }
 
-// Watch places a watch on a particular XenStore path
+// Watch places a watch on a particular XenStore path. The returned channel receives
+// the acknowledgement of the watch followed by its events, & is closed once the watch
+// is removed using UnWatch or the Client is closed.
 func (c *Client) Watch(path, token string) (chan *Packet, error) {
 	buf := bytes.NewBufferString(path)
 	buf.WriteByte(NUL)
@@ -199,20 +373,18 @@ func (c *Client) UnWatch(path, token string) error {
 	}
 
 	// Ensure the returned packet was not an error
-	if err := p.Check(); err != nil {
-		return err
-	}
-
-	c.router.removeWatchChannel(token)
-
-	return nil
+	return p.Check()
 }
 
 // Ensures that the <path> exists, by necessary by creating it and any missing parents with empty values.
 // If <path> or any parent already exists, its value is left unchanged.
 // Returns OK on success
 func (c *Client) Mkdir(path string) (string, error) {
-	p, err := c.submitBytes(XsMkdir, append([]byte(path), NUL), 0x0)
+	return c.mkdir(path, 0x0)
+}
+
+func (c *Client) mkdir(path string, txid uint32) (string, error) {
+	p, err := c.submitBytes(XsMkdir, append([]byte(path), NUL), txid)
 	if err != nil {
 		return "", err
 	}
@@ -1 +1,197 @@
-package xenstore
+package xenstore_test
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+// chanTransport is a Transport which hands sent packets to the test and returns
+// packets (or errors) provided by the test from Receive.
+type chanTransport struct {
+	sent     chan *Packet
+	received chan *Packet
+	errs     chan error
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func newChanTransport() *chanTransport {
+	return &chanTransport{
+		sent:     make(chan *Packet, 16),
+		received: make(chan *Packet),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (t *chanTransport) Send(p *Packet) error {
+	t.sent <- p
+	return nil
+}
+
+func (t *chanTransport) Receive() (*Packet, error) {
+	select {
+	case p := <-t.received:
+		return p, nil
+	case err := <-t.errs:
+		return nil, err
+	case <-t.closed:
+		return nil, io.EOF
+	}
+}
+
+func (t *chanTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	var orphans = make(chan *Packet, 1)
+
+	tr := newChanTransport()
+	c := NewClient(tr, WithRequestTimeout(10*time.Millisecond), WithOrphanPacketHandler(func(p *Packet) {
+		orphans <- p
+	}))
+	defer c.Close()
+
+	_, err := c.Read("/local/domain/0/name")
+	assert.True(t, errors.Is(err, ErrRequestTimeout))
+
+	// The late reply is handed to the orphan handler rather than being delivered
+	req := <-tr.sent
+	tr.received <- req
+	assert.Equal(t, req, <-orphans)
+}
+
+func TestClientDone(t *testing.T) {
+	tr := newChanTransport()
+	c := NewClient(tr)
+
+	assert.Nil(t, c.Error())
+
+	result := make(chan error)
+	go func() {
+		_, err := c.Read("/local/domain/0/name")
+		result <- err
+	}()
+
+	<-tr.sent
+	brokenPipe := errors.New("broken pipe")
+	tr.errs <- brokenPipe
+
+	assert.True(t, errors.Is(<-result, ErrConnectionLost))
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("router did not stop")
+	}
+
+	assert.Equal(t, brokenPipe, c.Error())
+
+	_, err := c.Read("/local/domain/0/name")
+	assert.True(t, errors.Is(err, ErrRouterStopped))
+}
+
+func TestClientReconnect(t *testing.T) {
+	first, second := newChanTransport(), newChanTransport()
+
+	c := NewClient(first, WithReconnectPolicy(ReconnectPolicy{
+		Dial: func() (Transport, error) {
+			return second, nil
+		},
+		Backoff: time.Millisecond,
+	}))
+	defer c.Close()
+
+	ch, err := c.Watch("/local/domain/0", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-first.sent
+
+	// The same token on another path is a separate watch
+	if _, err := c.Watch("/vm", "tok"); err != nil {
+		t.Fatal(err)
+	}
+	<-first.sent
+
+	first.errs <- io.ErrUnexpectedEOF
+
+	// Both watches are registered again on the new transport & events keep flowing
+	var rewatched [][]string
+	for i := 0; i < 2; i++ {
+		rewatch := <-second.sent
+		assert.Equal(t, XsWatch, rewatch.Header.Op)
+		rewatched = append(rewatched, rewatch.Strings())
+	}
+	assert.ElementsMatch(t, [][]string{{"/local/domain/0", "tok"}, {"/vm", "tok"}}, rewatched)
+
+	event := &Packet{
+		Header:  &PacketHeader{Op: XsWatchEvent},
+		Payload: []byte("/local/domain/0\x00tok\x00"),
+	}
+	second.received <- event
+	assert.Equal(t, event, <-ch)
+}
+
+func TestClientReadMany(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	for _, name := range []string{"name", "memory", "vm"} {
+		if _, err := c.Write("/local/domain/5/"+name, name+"-value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	values, errs := c.ReadMany([]string{
+		"/local/domain/5/name",
+		"/local/domain/5/memory",
+		"/local/domain/5/vm",
+		"/local/domain/5/missing",
+		"/local/domain/5/name",
+	})
+
+	assert.Equal(t, map[string]string{
+		"/local/domain/5/name":   "name-value",
+		"/local/domain/5/memory": "memory-value",
+		"/local/domain/5/vm":     "vm-value",
+	}, values)
+
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs["/local/domain/5/missing"], ErrNotFound))
+
+	err := c.Transact(func(tx *Transaction) error {
+		values, errs = tx.ReadMany([]string{"/local/domain/5/name", "/local/domain/5/vm"})
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, errs)
+	assert.Equal(t, "vm-value", values["/local/domain/5/vm"])
+}
+
+func TestClientListEmpty(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	if _, err := c.Write("/local/domain/5/name", "guest"); err != nil {
+		t.Fatal(err)
+	}
+
+	children, err := c.List("/local/domain/5/name")
+	assert.NoError(t, err)
+	assert.NotNil(t, children)
+	assert.Empty(t, children)
+
+	children, err = c.List("/local/domain/5")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"name"}, children)
+}
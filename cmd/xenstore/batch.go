@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/urfave/cli/v3"
+)
+
+// batchFlags are the flags accepted by every command which can operate on several
+// paths at once.
+var batchFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "stdin",
+		Usage: "Also read arguments from stdin, one per line",
+	},
+	&cli.BoolFlag{
+		Name:    "transaction",
+		Aliases: []string{"t"},
+		Usage:   "Apply all of the operations atomically in a single transaction",
+	},
+}
+
+// batchArgs returns the arguments given on the command line followed by those read
+// from stdin when --stdin is set. Empty lines are ignored.
+func batchArgs(cmd *cli.Command) ([]string, error) {
+	args := cmd.Args().Slice()
+
+	if cmd.Bool("stdin") {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				args = append(args, line)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return args, nil
+}
+
+// runBatch calls fn with the Client, or within a transaction when --transaction is
+// set. fn may be called more than once if the transaction has to be retried so it
+// must not print anything itself.
+func runBatch(cmd *cli.Command, fn func(s store) error) error {
+	if !cmd.Bool("transaction") {
+		return fn(client)
+	}
+
+	return client.Transact(func(tx *xenstore.Transaction) error {
+		return fn(tx)
+	})
+}
+
+// writePair is a single path & value to write.
+type writePair struct {
+	path  string
+	value string
+}
+
+// parseWritePairs converts the arguments to the write command into the pairs to
+// write. Each argument is a path=value pair, or the arguments may be a single path
+// followed by its value. Paths cannot contain "=" so the first one separates the path
+// from the value.
+func parseWritePairs(args []string) ([]writePair, error) {
+	if len(args) == 2 && !strings.Contains(args[0], "=") {
+		return []writePair{{args[0], args[1]}}, nil
+	}
+
+	pairs := make([]writePair, len(args))
+	for i, arg := range args {
+		path, value, ok := strings.Cut(arg, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("expected path=value but got %q", arg)
+		}
+
+		pairs[i] = writePair{path, value}
+	}
+
+	return pairs, nil
+}
+
+// readAll reads all of paths from s, returning the first error encountered in the
+// order of paths.
+func readAll(s store, paths []string) (map[string]string, error) {
+	values, errs := s.ReadMany(paths)
+
+	for _, path := range paths {
+		if err, ok := errs[path]; ok {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+// tap & captureFile write the capture requested using the global --capture flag.
+var (
+	tap         *xenstore.TapTransport
+	captureFile *os.File
+)
+
+// startCapture wraps t in a TapTransport writing every Packet to file.
+func startCapture(t xenstore.Transport, file string) (xenstore.Transport, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+
+	capture, err := xenstore.NewCaptureWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	captureFile = f
+	tap = xenstore.NewTapTransport(t, capture)
+	return tap, nil
+}
+
+// stopCapture closes the file written by the --capture flag, reporting any error
+// from writing it.
+func stopCapture() {
+	if tap == nil {
+		return
+	}
+
+	if err := tap.Err(); err != nil {
+		log.Warnf("Writing capture failed: %s", err)
+	}
+
+	if err := captureFile.Close(); err != nil {
+		log.Warnf("Writing capture failed: %s", err)
+	}
+}
+
+// decodeResult is the structured output for each Packet printed by DecodeCommand.
+type decodeResult struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Op        string    `json:"op"`
+	RqId      uint32    `json:"rq_id"`
+	TxId      uint32    `json:"tx_id"`
+	Payload   []string  `json:"payload"`
+}
+
+// decodeFilter selects the Packets printed by DecodeCommand. Replies are selected if
+// the request they answer was.
+type decodeFilter struct {
+	paths []string
+	ops   map[xenstore.Operation]bool
+	// selected holds the request IDs of the selected requests still awaiting a reply.
+	selected map[uint32]bool
+}
+
+func newDecodeFilter(paths, ops []string) (*decodeFilter, error) {
+	f := &decodeFilter{
+		paths:    paths,
+		selected: map[uint32]bool{},
+	}
+
+	for _, pattern := range paths {
+		if _, err := xenstore.MatchGlob(pattern, xenstore.XenStorePathSeparator); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ops) > 0 {
+		f.ops = map[xenstore.Operation]bool{}
+		for _, name := range ops {
+			op, err := xenstore.ParseOperation(name)
+			if err != nil {
+				return nil, err
+			}
+			f.ops[op] = true
+		}
+	}
+
+	return f, nil
+}
+
+func (f *decodeFilter) match(rec *xenstore.CaptureRecord) bool {
+	p := rec.Packet
+
+	if rec.Direction == xenstore.CaptureReceived && p.Header.Op != xenstore.XsWatchEvent {
+		if !f.selected[p.Header.RqId] {
+			return false
+		}
+
+		delete(f.selected, p.Header.RqId)
+		return true
+	}
+
+	if f.ops != nil && !f.ops[p.Header.Op] {
+		return false
+	}
+
+	if !f.matchPath(p.Strings()[0]) {
+		return false
+	}
+
+	if rec.Direction == xenstore.CaptureSent {
+		f.selected[p.Header.RqId] = true
+	}
+
+	return true
+}
+
+// matchPath checks the first argument of a request, or the path of a watch event,
+// against the --path patterns.
+func (f *decodeFilter) matchPath(p string) bool {
+	if len(f.paths) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.paths {
+		// The patterns were checked by newDecodeFilter so this cannot fail
+		if ok, _ := xenstore.MatchGlob(pattern, p); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DecodeCommand prints the Packets in a capture written using --capture.
+func DecodeCommand(ctx context.Context, cmd *cli.Command) error {
+	file := cmd.Args().First()
+	if file == "" {
+		return cli.Exit("Please specify the capture file to decode, or - for stdin", 3)
+	}
+
+	filter, err := newDecodeFilter(cmd.StringSlice("path"), cmd.StringSlice("op"))
+	if err != nil {
+		return cli.Exit(err.Error(), 3)
+	}
+
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return fail(err)
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	capture, err := xenstore.NewCaptureReader(r)
+	if err != nil {
+		return fail(fmt.Errorf("reading capture %s: %w", file, err))
+	}
+
+	// Text & ndjson are printed as each Packet is read, but json has to be collected
+	// into a single array
+	var results []decodeResult
+
+	for {
+		rec, err := capture.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(fmt.Errorf("reading capture %s: %w", file, err))
+		}
+
+		if !filter.match(rec) {
+			continue
+		}
+
+		result := newDecodeResult(rec)
+		if output == outputJSON {
+			results = append(results, result)
+		} else {
+			printResult(result, func() { printDecoded(rec, result) })
+		}
+	}
+
+	if output == outputJSON {
+		printResults(results, nil)
+	}
+
+	return nil
+}
+
+func newDecodeResult(rec *xenstore.CaptureRecord) decodeResult {
+	p := rec.Packet
+
+	return decodeResult{
+		Time:      rec.Time,
+		Direction: rec.Direction.String(),
+		Op:        p.Header.Op.String(),
+		RqId:      p.Header.RqId,
+		TxId:      p.Header.TxId,
+		Payload:   p.Strings(),
+	}
+}
+
+// printDecoded prints a single captured Packet as text, with requests marked by ">" &
+// replies & watch events by "<".
+func printDecoded(rec *xenstore.CaptureRecord, result decodeResult) {
+	marker := ">"
+	if rec.Direction == xenstore.CaptureReceived {
+		marker = "<"
+	}
+
+	payload := make([]string, len(result.Payload))
+	for i, s := range result.Payload {
+		payload[i] = fmt.Sprintf("\"%s\"", sanitiseValue(s))
+	}
+
+	fmt.Printf("%s %s %s rqid=%d txid=%d %s\n", rec.Time.Format("15:04:05.000000"),
+		marker, result.Op, result.RqId, result.TxId, strings.Join(payload, " "))
+}
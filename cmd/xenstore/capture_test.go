@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// captured creates a CaptureRecord for a Packet with the given payload.
+func captured(dir xenstore.CaptureDirection, op xenstore.Operation, rqid uint32, payload ...string) *xenstore.CaptureRecord {
+	return &xenstore.CaptureRecord{
+		Direction: dir,
+		Packet: &xenstore.Packet{
+			Header:  &xenstore.PacketHeader{Op: op, RqId: rqid},
+			Payload: []byte(strings.Join(payload, "\x00") + "\x00"),
+		},
+	}
+}
+
+func TestDecodeFilter(t *testing.T) {
+	// A small conversation in the order it was captured, with the replies to the
+	// reads arriving out of order
+	capture := []*xenstore.CaptureRecord{
+		captured(xenstore.CaptureSent, xenstore.XsRead, 1, "/local/domain/1/name"),
+		captured(xenstore.CaptureSent, xenstore.XsRead, 2, "/vm/1/name"),
+		captured(xenstore.CaptureReceived, xenstore.XsRead, 2, "guest"),
+		captured(xenstore.CaptureReceived, xenstore.XsRead, 1, "guest"),
+		captured(xenstore.CaptureSent, xenstore.XsWrite, 3, "/local/domain/1/data/key", "value"),
+		captured(xenstore.CaptureReceived, xenstore.XsError, 3, "EACCES"),
+		captured(xenstore.CaptureSent, xenstore.XsWatch, 4, "/local/domain/1", "token"),
+		captured(xenstore.CaptureReceived, xenstore.XsWatch, 4, "OK"),
+		captured(xenstore.CaptureReceived, xenstore.XsWatchEvent, 0, "/local/domain/1/name", "token"),
+		captured(xenstore.CaptureReceived, xenstore.XsWatchEvent, 0, "/vm/1/name", "token"),
+		// A reply to a request which was not captured
+		captured(xenstore.CaptureReceived, xenstore.XsRead, 9, "orphan"),
+	}
+
+	tests := []struct {
+		name     string
+		paths    []string
+		ops      []string
+		expected []int
+	}{
+		{
+			name:     "everything",
+			expected: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		},
+		{
+			name:     "path",
+			paths:    []string{"/local/domain/*/name"},
+			expected: []int{0, 3, 8},
+		},
+		{
+			// ** also matches no components at all, so this includes the watch
+			name:     "recursive path",
+			paths:    []string{"/local/domain/1/**"},
+			expected: []int{0, 3, 4, 5, 6, 7, 8},
+		},
+		{
+			name:     "several paths",
+			paths:    []string{"/vm/**", "/local/domain/1"},
+			expected: []int{1, 2, 6, 7, 9},
+		},
+		{
+			name:     "op",
+			ops:      []string{"write"},
+			expected: []int{4, 5},
+		},
+		{
+			name:     "op and path",
+			paths:    []string{"/vm/**"},
+			ops:      []string{"read", "watch_event"},
+			expected: []int{1, 2, 9},
+		},
+		{
+			name:     "no match",
+			paths:    []string{"/tool/**"},
+			expected: nil,
+		},
+	}
+
+	for _, test := range tests {
+		filter, err := newDecodeFilter(test.paths, test.ops)
+		if !assert.NoError(t, err, test.name) {
+			continue
+		}
+
+		var matched []int
+		for i, rec := range capture {
+			if filter.match(rec) {
+				matched = append(matched, i)
+			}
+		}
+
+		assert.Equal(t, test.expected, matched, test.name)
+		assert.Empty(t, filter.selected, test.name)
+	}
+}
+
+func TestNewDecodeFilterInvalid(t *testing.T) {
+	_, err := newDecodeFilter([]string{"/local/domain/[1"}, nil)
+	assert.Error(t, err)
+
+	_, err = newDecodeFilter(nil, []string{"raed"})
+	assert.Error(t, err)
+}
@@ -4,62 +4,151 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
-	"syscall"
 
 	xenstore "github.com/joelnb/xenstore-go"
 	"github.com/urfave/cli/v3"
 )
 
+// valueResult is the structured output for a single node.
+type valueResult struct {
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+// statusResult is the structured output of commands which modify a node.
+type statusResult struct {
+	Path   string `json:"path"`
+	Result string `json:"result"`
+}
+
+// childResult is the structured output for each child listed by ListCommand.
+type childResult struct {
+	Name  string   `json:"name"`
+	Path  string   `json:"path"`
+	Perms []string `json:"perms,omitempty"`
+}
+
+// findResult is the structured output for each path found by FindCommand. Value is
+// only included when filtering on it.
+type findResult struct {
+	Path  string  `json:"path"`
+	Value *string `json:"value,omitempty"`
+}
+
 func ReadCommand(ctx context.Context, cmd *cli.Command) error {
-	path := cmd.Args().First()
-	if path == "" {
+	paths, err := batchArgs(cmd)
+	if err != nil {
+		return cli.Exit(err.Error(), 3)
+	}
+
+	if len(paths) == 0 {
 		return cli.Exit("Please specify the XenStore path to read", 3)
 	}
 
-	val, err := client.Read(path)
+	var values map[string]string
+	err = runBatch(cmd, func(s store) error {
+		values, err = readAll(s, paths)
+		return err
+	})
 	if err != nil {
-		return cli.Exit(err.Error(), 2)
+		return fail(err)
+	}
+
+	results := make([]valueResult, len(paths))
+	for i, path := range paths {
+		results[i] = valueResult{Path: path, Value: values[path]}
 	}
 
-	fmt.Println(val)
+	printResults(results, func() {
+		for _, result := range results {
+			fmt.Println(result.Value)
+		}
+	})
 	return nil
 }
 
 func RmCommand(ctx context.Context, cmd *cli.Command) error {
-	path := cmd.Args().First()
-	if path == "" {
-		return cli.Exit("Please specify the XenStore path to remove", 3)
+	return modifyPaths(cmd, "remove", store.Remove)
+}
+
+func WriteCommand(ctx context.Context, cmd *cli.Command) error {
+	args, err := batchArgs(cmd)
+	if err != nil {
+		return cli.Exit(err.Error(), 3)
+	}
+
+	if len(args) == 0 {
+		return cli.Exit("Please specify the XenStore path to write", 3)
+	}
+
+	if len(args) == 1 && !strings.Contains(args[0], "=") {
+		return cli.Exit("Please specify the value to write", 3)
 	}
 
-	val, err := client.Remove(path)
+	pairs, err := parseWritePairs(args)
 	if err != nil {
-		return cli.Exit(err.Error(), 2)
+		return cli.Exit(err.Error(), 3)
+	}
+
+	results := make([]statusResult, len(pairs))
+	err = runBatch(cmd, func(s store) error {
+		for i, pair := range pairs {
+			val, err := s.Write(pair.path, pair.value)
+			if err != nil {
+				return err
+			}
+
+			results[i] = statusResult{Path: pair.path, Result: val}
+		}
+		return nil
+	})
+	if err != nil {
+		return fail(err)
 	}
 
-	fmt.Println(val)
+	printResults(results, func() {
+		for _, result := range results {
+			fmt.Println(result.Result)
+		}
+	})
 	return nil
 }
 
-func WriteCommand(ctx context.Context, cmd *cli.Command) error {
-	path := cmd.Args().First()
-	if path == "" {
-		return cli.Exit("Please specify the XenStore path to write", 3)
+// modifyPaths applies op to each of the paths given to cmd.
+func modifyPaths(cmd *cli.Command, action string, op func(s store, path string) (string, error)) error {
+	paths, err := batchArgs(cmd)
+	if err != nil {
+		return cli.Exit(err.Error(), 3)
 	}
 
-	val := cmd.Args().Get(1)
-	if path == "" {
-		return cli.Exit("Please specify the value to write", 3)
+	if len(paths) == 0 {
+		return cli.Exit(fmt.Sprintf("Please specify the XenStore path to %s", action), 3)
 	}
 
-	val, err := client.Write(path, val)
+	results := make([]statusResult, len(paths))
+	err = runBatch(cmd, func(s store) error {
+		for i, path := range paths {
+			val, err := op(s, path)
+			if err != nil {
+				return err
+			}
+
+			results[i] = statusResult{Path: path, Result: val}
+		}
+		return nil
+	})
 	if err != nil {
-		return cli.Exit(err.Error(), 2)
+		return fail(err)
 	}
 
-	fmt.Println(val)
+	printResults(results, func() {
+		for _, result := range results {
+			fmt.Println(result.Result)
+		}
+	})
 	return nil
 }
 
@@ -76,10 +165,17 @@ func VMPathCommand(ctx context.Context, cmd *cli.Command) error {
 
 	path, err := client.GetDomainPath(domidInt)
 	if err != nil {
-		return cli.Exit(err.Error(), 2)
+		return fail(err)
 	}
 
-	fmt.Println(path)
+	result := struct {
+		DomID int    `json:"domid"`
+		Path  string `json:"path"`
+	}{domidInt, path}
+
+	printResult(result, func() {
+		fmt.Println(path)
+	})
 	return nil
 }
 
@@ -89,93 +185,125 @@ func ListCommand(ctx context.Context, cmd *cli.Command) error {
 		return cli.Exit("Please specify the XenStore path to list", 3)
 	}
 
+	if cmd.Bool("recursive") {
+		return TreeCommand(ctx, cmd)
+	}
+
 	subpaths, err := client.List(path)
 	if err != nil {
-		return cli.Exit(err.Error(), 2)
+		return fail(err)
 	}
 
-	if cmd.Bool("long") {
-		for _, subpath := range subpaths {
-			fullpath := xenstore.JoinXenStorePath(path, subpath)
+	long := cmd.Bool("long")
+
+	results := make([]childResult, len(subpaths))
+	for i, subpath := range subpaths {
+		results[i] = childResult{
+			Name: subpath,
+			Path: xenstore.JoinXenStorePath(path, subpath),
+		}
 
-			perms, err := client.GetPermissions(fullpath)
+		if long {
+			perms, err := client.GetPermissions(results[i].Path)
 			if err != nil {
-				return cli.Exit(err.Error(), 2)
+				return fail(err)
 			}
 
-			fmt.Println(fullpath, perms)
+			results[i].Perms = strings.Split(perms, "\x00")
 		}
-	} else {
-		fmt.Println(strings.Trim(fmt.Sprint(subpaths), "[]"))
 	}
 
+	printResults(results, func() {
+		if !long {
+			fmt.Println(strings.Trim(fmt.Sprint(subpaths), "[]"))
+			return
+		}
+
+		for _, result := range results {
+			fmt.Println(result.Path, strings.Join(result.Perms, "\x00"))
+		}
+	})
+
+	return nil
+}
+
+func InfoCommand(ctx context.Context, cmd *cli.Command) error {
+	result := struct {
+		SocketPath    string `json:"socket_path"`
+		ROSocketPath  string `json:"ro_socket_path"`
+		XenBusPath    string `json:"xenbus_path"`
+		ControlDomain bool   `json:"control_domain"`
+		Version       string `json:"version"`
+		GitCommit     string `json:"git_commit"`
+	}{
+		SocketPath:    xenstore.UnixSocketPath(),
+		ROSocketPath:  xenstore.ReadOnlyUnixSocketPath(),
+		XenBusPath:    xenstore.XenBusPath(),
+		ControlDomain: xenstore.ControlDomain(),
+		Version:       Version,
+		GitCommit:     GitCommit,
+	}
+
+	printResult(result, func() {
+		fmt.Println("Socket Path:", result.SocketPath)
+		fmt.Println("RO Socket Path:", result.ROSocketPath)
+		fmt.Println("XenBus Path:", result.XenBusPath)
+		fmt.Println("ControlDomain:", result.ControlDomain)
+		fmt.Println()
+		fmt.Println("Version:", result.Version)
+		fmt.Println("GitCommit:", result.GitCommit)
+	})
 	return nil
 }
 
-func WatchCommand(ctx context.Context, cmd *cli.Command) error {
-	path := cmd.Args().First()
-	if path == "" {
-		return cli.Exit("Please specify the XenStore path to watch", 3)
+func MkdirCommand(ctx context.Context, cmd *cli.Command) error {
+	return modifyPaths(cmd, "create", store.Mkdir)
+}
+
+func FindCommand(ctx context.Context, cmd *cli.Command) error {
+	pattern := cmd.Args().First()
+	if pattern == "" {
+		return cli.Exit("Please specify the pattern to search for", 3)
 	}
 
-	token := cmd.Args().Get(1)
-	if token == "" {
-		return cli.Exit("Please specify the token to create the watch with", 3)
+	var valueRegex *regexp.Regexp
+	if expr := cmd.String("value-regex"); expr != "" {
+		var err error
+		if valueRegex, err = regexp.Compile(expr); err != nil {
+			return cli.Exit(err.Error(), 3)
+		}
 	}
 
-	ch, err := client.Watch(path, token)
+	paths, err := client.Glob(pattern)
 	if err != nil {
-		return cli.Exit(err.Error(), 2)
+		return fail(err)
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	var results []findResult
 
-OUTER:
-	for {
-		select {
-		case rsp := <-ch:
-			if err := rsp.Check(); err != nil {
-				return cli.Exit(err.Error(), 2)
-			} else {
-				fmt.Println(rsp)
+	if valueRegex == nil {
+		for _, path := range paths {
+			results = append(results, findResult{Path: path})
+		}
+	} else {
+		values, errs := client.ReadMany(paths)
+		for _, path := range paths {
+			if err, ok := errs[path]; ok {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+				continue
 			}
 
-		case sig := <-sigs:
-			fmt.Printf("Got signal %s, removing watch and exiting!", sig)
-
-			if err := client.UnWatch(path, token); err != nil {
-				return cli.Exit(err.Error(), 2)
+			if value := values[path]; valueRegex.MatchString(value) {
+				results = append(results, findResult{Path: path, Value: &value})
 			}
-
-			break OUTER
 		}
 	}
 
-	return nil
-}
-
-func InfoCommand(ctx context.Context, cmd *cli.Command) error {
-	fmt.Println("Socket Path:", xenstore.UnixSocketPath())
-	fmt.Println("XenBus Path:", xenstore.XenBusPath())
-	fmt.Println("ControlDomain:", xenstore.ControlDomain())
-	fmt.Println()
-	fmt.Println("Version:", Version)
-	fmt.Println("GitCommit:", GitCommit)
-	return nil
-}
-
-func MkdirCommand(ctx context.Context, cmd *cli.Command) error {
-	path := cmd.Args().First()
-	if path == "" {
-		return cli.Exit("Please specify the XenStore path to create", 3)
-	}
-
-	val, err := client.Mkdir(path)
-	if err != nil {
-		return cli.Exit(err.Error(), 2)
-	}
+	printResults(results, func() {
+		for _, result := range results {
+			fmt.Println(result.Path)
+		}
+	})
 
-	fmt.Println(val)
 	return nil
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/urfave/cli/v3"
+)
+
+// readSnapshot reads a snapshot written by SnapshotCommand from file, or from stdin if
+// file is "-".
+func readSnapshot(file string) (*xenstore.Node, error) {
+	var r io.Reader = os.Stdin
+
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	node := &xenstore.Node{}
+	if err := json.NewDecoder(r).Decode(node); err != nil {
+		return nil, fmt.Errorf("reading snapshot %s: %w", file, err)
+	}
+
+	return node, nil
+}
+
+// printDiff prints the differences found by DiffCommand or applied by SyncCommand.
+func printDiff(entries []xenstore.DiffEntry) {
+	printResults(entries, func() {
+		for _, entry := range entries {
+			p := entry.Path
+			if p == "" {
+				p = "."
+			}
+
+			switch entry.Kind {
+			case xenstore.DiffAdded:
+				fmt.Printf("+ %s = \"%s\"%s\n", p, sanitiseValue(entry.NewValue), formatDiffPerms(nil, entry.NewPerms))
+			case xenstore.DiffRemoved:
+				fmt.Printf("- %s\n", p)
+			case xenstore.DiffChanged:
+				var value string
+				if entry.OldValue != entry.NewValue {
+					value = fmt.Sprintf(" \"%s\" -> \"%s\"", sanitiseValue(entry.OldValue), sanitiseValue(entry.NewValue))
+				}
+				fmt.Printf("~ %s%s%s\n", p, value, formatDiffPerms(entry.OldPerms, entry.NewPerms))
+			}
+		}
+	})
+}
+
+// formatDiffPerms describes a change of permissions, or returns an empty string if
+// there is nothing to show.
+func formatDiffPerms(old, new []string) string {
+	switch {
+	case new == nil:
+		return ""
+	case old == nil:
+		return fmt.Sprintf(" (%s)", strings.Join(new, ","))
+	case strings.Join(old, ",") == strings.Join(new, ","):
+		return ""
+	}
+
+	return fmt.Sprintf(" (%s) -> (%s)", strings.Join(old, ","), strings.Join(new, ","))
+}
+
+func SnapshotCommand(ctx context.Context, cmd *cli.Command) error {
+	path := cmd.Args().First()
+	if path == "" {
+		return cli.Exit("Please specify the XenStore path to snapshot", 3)
+	}
+
+	node, err := client.Snapshot(path)
+	if err != nil {
+		return fail(err)
+	}
+
+	// The snapshot is always JSON so that it can be given to diff --snapshot & sync
+	enc := json.NewEncoder(os.Stdout)
+	if output != outputNDJSON {
+		enc.SetIndent("", "  ")
+	}
+
+	return enc.Encode(node)
+}
+
+func DiffCommand(ctx context.Context, cmd *cli.Command) error {
+	var a, b *xenstore.Node
+
+	if file := cmd.String("snapshot"); file != "" {
+		if cmd.Args().Len() != 1 {
+			return cli.Exit("Please specify the XenStore path to compare with the snapshot", 3)
+		}
+
+		var err error
+		if a, err = readSnapshot(file); err != nil {
+			return cli.Exit(err.Error(), 3)
+		}
+
+		if b, err = client.Snapshot(cmd.Args().First()); err != nil {
+			return fail(err)
+		}
+	} else {
+		if cmd.Args().Len() != 2 {
+			return cli.Exit("Please specify the two XenStore paths to compare", 3)
+		}
+
+		// Read both subtrees in one transaction so they are compared at the same moment
+		err := client.Transact(func(tx *xenstore.Transaction) error {
+			var err error
+			if a, err = tx.Snapshot(cmd.Args().Get(0)); err != nil {
+				return err
+			}
+
+			b, err = tx.Snapshot(cmd.Args().Get(1))
+			return err
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if cmd.Bool("ignore-perms") {
+		*a, *b = withoutPerms(*a), withoutPerms(*b)
+	}
+
+	entries := xenstore.Diff(*a, *b)
+
+	printDiff(entries)
+
+	// Like diff(1), exit with 1 if the trees differ
+	if len(entries) > 0 {
+		return cli.Exit("", 1)
+	}
+
+	return nil
+}
+
+// withoutPerms returns a copy of node with the permissions of every node removed, so
+// that they are not compared.
+func withoutPerms(node xenstore.Node) xenstore.Node {
+	stripped := xenstore.Node{Value: node.Value}
+
+	if node.Children != nil {
+		stripped.Children = make(map[string]*xenstore.Node, len(node.Children))
+		for name, child := range node.Children {
+			c := withoutPerms(*child)
+			stripped.Children[name] = &c
+		}
+	}
+
+	return stripped
+}
+
+func SyncCommand(ctx context.Context, cmd *cli.Command) error {
+	if cmd.Args().Len() != 2 {
+		return cli.Exit("Please specify the XenStore path and the snapshot to sync it to", 3)
+	}
+
+	desired, err := readSnapshot(cmd.Args().Get(1))
+	if err != nil {
+		return cli.Exit(err.Error(), 3)
+	}
+
+	path := cmd.Args().Get(0)
+
+	var entries []xenstore.DiffEntry
+	if cmd.Bool("dry-run") {
+		// Make the changes in a transaction which is then thrown away
+		tx, err := client.StartTransaction()
+		if err != nil {
+			return fail(err)
+		}
+
+		entries, err = tx.Sync(path, desired)
+		if abortErr := tx.Abort(); err == nil {
+			err = abortErr
+		}
+		if err != nil {
+			return fail(err)
+		}
+	} else if entries, err = client.Sync(path, desired); err != nil {
+		return fail(err)
+	}
+
+	printDiff(entries)
+	return nil
+}
@@ -13,6 +13,31 @@ import (
 
 var client *xenstore.Client
 
+// offlineCommands do not use the global connection to xenstore, either because they
+// need no connection or because they make their own.
+var offlineCommands = map[string]bool{
+	"decode": true,
+	"proxy":  true,
+}
+
+// closeClient closes the global connection to xenstore, if one was opened, returning
+// the error which stopped it early if there was one.
+func closeClient() error {
+	if client == nil {
+		return nil
+	}
+
+	closeErr := client.Close()
+	<-client.Done()
+	stopCapture()
+
+	if storedErr := client.Error(); storedErr != nil {
+		return storedErr
+	}
+
+	return closeErr
+}
+
 func main() {
 	app := &cli.Command{
 		Usage:   "XenStore tools in Go",
@@ -20,7 +45,7 @@ func main() {
 		Metadata: map[string]interface{}{
 			"compiled": time.Now(),
 		},
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:  "socket-path",
 				Usage: "Path to the xenstore unix socket",
@@ -33,11 +58,29 @@ func main() {
 				Name:  "use-socket, s",
 				Usage: "Use the socket rather than the xenbus device",
 			},
+			&cli.BoolFlag{
+				Name:  "use-xenbus",
+				Usage: "Use the xenbus device rather than the socket (by default the socket is tried first)",
+			},
+			&cli.BoolFlag{
+				Name:  "read-only",
+				Usage: "Connect to the read-only xenstore socket (implies --use-socket)",
+			},
 			&cli.BoolFlag{
 				Name:  "verbose, V",
 				Usage: "More verbose output",
 			},
-		},
+			&cli.StringFlag{
+				Name:  "capture",
+				Usage: "Write every packet exchanged with xenstore to this file, for reading with the decode command",
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Value:   outputText,
+				Usage:   "Output format: text, json or ndjson",
+			},
+		}, remoteFlags...),
 		Before: func(ctx context.Context, cmd *cli.Command) (context.Context, error) {
 			// Output to stderr instead of stdout, could also be a file.
 			log.SetOutput(os.Stderr)
@@ -50,10 +93,24 @@ func main() {
 				log.SetLevel(log.DebugLevel)
 			}
 
-			t, err := getTransport(cmd)
+			if err := setOutputFormat(cmd.String("output")); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(3)
+			}
+
+			if offlineCommands[cmd.Args().First()] {
+				return ctx, nil
+			}
+
+			t, err := openTransport(cmd)
+			if err == nil && cmd.IsSet("capture") {
+				t, err = startCapture(t, cmd.String("capture"))
+			}
 			if err != nil {
 				// Returning an error here causes usage text to be printed so just exit instead
-				fmt.Println(err)
+				printResult(newErrorResult(err), func() {
+					fmt.Println(err)
+				})
 				os.Exit(2)
 			}
 
@@ -62,48 +119,49 @@ func main() {
 			return ctx, nil
 		},
 		After: func(ctx context.Context, cmd *cli.Command) error {
-			if client == nil {
-				return nil
-			}
-
-			closeErr := client.Close()
-
-			if storedErr := client.Error(); storedErr != nil {
-				return storedErr
-			}
-
-			return closeErr
+			return closeClient()
 		},
 		Commands: []*cli.Command{
 			&cli.Command{
 				Name:   "read",
-				Flags:  []cli.Flag{},
-				Usage:  "Read values from xenstore by path",
+				Flags:  batchFlags,
+				Usage:  "Read values from xenstore by path (read <path>...)",
 				Action: ReadCommand,
 			},
 			&cli.Command{
 				Name:   "write",
-				Flags:  []cli.Flag{},
-				Usage:  "Write values to xenstore by path",
+				Flags:  batchFlags,
+				Usage:  "Write values to xenstore by path (write <path> <value> or write <path>=<value>...)",
 				Action: WriteCommand,
 			},
 			&cli.Command{
 				Name:   "rm",
-				Flags:  []cli.Flag{},
-				Usage:  "Remove a value from xenstore by path",
+				Flags:  batchFlags,
+				Usage:  "Remove values from xenstore by path (rm <path>...)",
 				Action: RmCommand,
 			},
 			&cli.Command{
 				Name:    "list",
 				Aliases: []string{"ls"},
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.BoolFlag{
 						Name: "long, l",
 					},
-				},
+					&cli.BoolFlag{
+						Name:    "recursive",
+						Aliases: []string{"r"},
+						Usage:   "List the whole tree below path in the same format as xenstore-ls",
+					},
+				}, treeFlags...),
 				Usage:  "List values from xenstore by path",
 				Action: ListCommand,
 			},
+			&cli.Command{
+				Name:   "tree",
+				Flags:  treeFlags,
+				Usage:  "Print the tree below a path (default /) in the same format as xenstore-ls",
+				Action: TreeCommand,
+			},
 			&cli.Command{
 				Name:   "vm-path",
 				Flags:  []cli.Flag{},
@@ -112,16 +170,101 @@ func main() {
 			},
 			&cli.Command{
 				Name:   "watch",
-				Flags:  []cli.Flag{},
-				Usage:  "Watch a XenStore path for changes",
+				Flags:  watchFlags,
+				Usage:  "Watch a XenStore path for changes (watch <path> [token])",
 				Action: WatchCommand,
 			},
 			&cli.Command{
 				Name:   "mkdir",
-				Flags:  []cli.Flag{},
-				Usage:  "Create path in xenstore",
+				Flags:  batchFlags,
+				Usage:  "Create paths in xenstore (mkdir <path>...)",
 				Action: MkdirCommand,
 			},
+			&cli.Command{
+				Name: "find",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "value-regex",
+						Usage: "Only print paths whose value matches this regular expression",
+					},
+				},
+				Usage:  "Find paths matching a pattern such as /local/domain/*/device/{vif,vbd}/*/state",
+				Action: FindCommand,
+			},
+			&cli.Command{
+				Name:   "snapshot",
+				Flags:  []cli.Flag{},
+				Usage:  "Print the tree below a path, including permissions, as JSON (snapshot <path>)",
+				Action: SnapshotCommand,
+			},
+			&cli.Command{
+				Name: "diff",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "snapshot",
+						Usage: "Compare a snapshot file (or - for stdin) with the path instead of two paths",
+					},
+					&cli.BoolFlag{
+						Name:  "ignore-perms",
+						Usage: "Only compare values",
+					},
+				},
+				Usage:  "Compare two trees, exiting with 1 if they differ (diff <pathA> <pathB> or diff --snapshot <file> <path>)",
+				Action: DiffCommand,
+			},
+			&cli.Command{
+				Name: "sync",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Print the changes which would be made without making them",
+					},
+				},
+				Usage:  "Change the tree below a path to match a snapshot file, or - for stdin (sync <path> <file>)",
+				Action: SyncCommand,
+			},
+			&cli.Command{
+				Name:   "shell",
+				Flags:  []cli.Flag{},
+				Usage:  "Start an interactive shell for exploring xenstore",
+				Action: ShellCommand,
+			},
+			&cli.Command{
+				Name: "mount",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "allow-other",
+						Usage: "Allow other users to access the mounted filesystem",
+					},
+					&cli.BoolFlag{
+						Name:  "debug",
+						Usage: "Log every FUSE request",
+					},
+				},
+				Usage:  "Mount xenstore as a FUSE filesystem (mount <mountpoint> [path])",
+				Action: MountCommand,
+			},
+			&cli.Command{
+				Name:   "proxy",
+				Flags:  proxyFlags,
+				Usage:  "Serve the local xenstore over TCP for use with --connect, which requires --client-ca, --allow-path or --allow-op unless --insecure is given",
+				Action: ProxyCommand,
+			},
+			&cli.Command{
+				Name: "decode",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "path",
+						Usage: "Only show requests whose path matches this pattern, as accepted by find, & their replies (may be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "op",
+						Usage: "Only show requests for this operation, such as read or transaction_start, & their replies (may be repeated)",
+					},
+				},
+				Usage:  "Print the packets in a file written using --capture or by xenstoretest.Recorder, or - for stdin (decode <file>)",
+				Action: DecodeCommand,
+			},
 			&cli.Command{
 				Name:   "info",
 				Flags:  []cli.Flag{},
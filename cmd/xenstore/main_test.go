@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveEcho accepts connections on l, replying to every request with its own payload.
+func serveEcho(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			server := xenstore.NewReadWriteTransport(conn)
+			defer server.Close()
+
+			for {
+				p, err := server.Receive()
+				if err != nil || server.Send(p) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestCloseClientUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socket")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go serveEcho(l)
+	defer func() { client = nil }()
+
+	// Every command closes the connection once it has finished, which must not be
+	// reported as the connection failing
+	for i := 0; i < 20; i++ {
+		tr, err := xenstore.NewUnixSocketTransport(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client = xenstore.NewClient(tr)
+
+		value, err := client.Read("/a")
+		assert.NoError(t, err)
+		assert.Equal(t, "/a", value)
+
+		assert.NoError(t, closeClient())
+	}
+}
@@ -0,0 +1,379 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	xenstore "github.com/joelnb/xenstore-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+// mountWatchToken is the token used for the watch which keeps the kernel's caches up
+// to date with changes made outside of the mount.
+const mountWatchToken = "xenstore-go-mount"
+
+// mountState is shared by every node in a mounted tree.
+type mountState struct {
+	root string
+	fsys fs.FS
+
+	// dirs holds the nodes created using mkdir through the mount. They have no
+	// children yet but need to keep appearing as directories.
+	lock sync.Mutex
+	dirs map[string]bool
+}
+
+// xsNode is a single XenStore node in the mounted tree. name is relative to the root
+// of the mount, using "." for the root itself.
+type xsNode struct {
+	fusefs.Inode
+
+	state *mountState
+	name  string
+}
+
+var (
+	_ = (fusefs.NodeLookuper)((*xsNode)(nil))
+	_ = (fusefs.NodeReaddirer)((*xsNode)(nil))
+	_ = (fusefs.NodeGetattrer)((*xsNode)(nil))
+	_ = (fusefs.NodeSetattrer)((*xsNode)(nil))
+	_ = (fusefs.NodeOpener)((*xsNode)(nil))
+	_ = (fusefs.NodeReader)((*xsNode)(nil))
+	_ = (fusefs.NodeWriter)((*xsNode)(nil))
+	_ = (fusefs.NodeCreater)((*xsNode)(nil))
+	_ = (fusefs.NodeMkdirer)((*xsNode)(nil))
+	_ = (fusefs.NodeUnlinker)((*xsNode)(nil))
+	_ = (fusefs.NodeRmdirer)((*xsNode)(nil))
+)
+
+// toErrno converts an error returned by the Client to the errno to return to the
+// kernel.
+func toErrno(err error) syscall.Errno {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return syscall.ENOENT
+	}
+
+	return syscall.EIO
+}
+
+func (s *mountState) fullPath(name string) string {
+	if name == "." {
+		return s.root
+	}
+
+	return xenstore.JoinXenStorePath(s.root, name)
+}
+
+func (s *mountState) isMkdir(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.dirs[name]
+}
+
+func (s *mountState) setMkdir(name string, dir bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if dir {
+		s.dirs[name] = true
+	} else {
+		delete(s.dirs, name)
+	}
+}
+
+// stat fetches the details of a node & fills in attr from them.
+func (s *mountState) stat(name string, attr *fuse.Attr) (bool, syscall.Errno) {
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		return false, toErrno(err)
+	}
+
+	dir := info.IsDir() || s.isMkdir(name)
+
+	attr.Mode = fuse.S_IFREG | 0644
+	attr.Size = uint64(info.Size())
+	if dir {
+		attr.Mode = fuse.S_IFDIR | 0755
+		attr.Size = 0
+	}
+	attr.Owner = *fuse.CurrentOwner()
+
+	return dir, fusefs.OK
+}
+
+func (n *xsNode) child(name string) string {
+	return path.Join(n.name, name)
+}
+
+func (n *xsNode) newChild(ctx context.Context, name string, dir bool) *fusefs.Inode {
+	mode := uint32(fuse.S_IFREG)
+	if dir {
+		mode = fuse.S_IFDIR
+	}
+
+	return n.NewInode(ctx, &xsNode{state: n.state, name: n.child(name)}, fusefs.StableAttr{Mode: mode})
+}
+
+func (n *xsNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	dir, errno := n.state.stat(n.child(name), &out.Attr)
+	if errno != fusefs.OK {
+		return nil, errno
+	}
+
+	return n.newChild(ctx, name, dir), fusefs.OK
+}
+
+func (n *xsNode) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	entries, err := fs.ReadDir(n.state.fsys, n.name)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+
+	list := make([]fuse.DirEntry, len(entries))
+	for i, entry := range entries {
+		list[i] = fuse.DirEntry{Name: entry.Name(), Mode: fuse.S_IFREG}
+		if entry.IsDir() || n.state.isMkdir(n.child(entry.Name())) {
+			list[i].Mode = fuse.S_IFDIR
+		}
+	}
+
+	return fusefs.NewListDirStream(list), fusefs.OK
+}
+
+func (n *xsNode) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	_, errno := n.state.stat(n.name, &out.Attr)
+	return errno
+}
+
+func (n *xsNode) Setattr(ctx context.Context, f fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		value, err := client.Read(n.state.fullPath(n.name))
+		if err != nil {
+			return toErrno(err)
+		}
+
+		// Padding with NUL bytes would not survive being read back, as XenStore
+		// values are NUL terminated, so only shrinking is supported
+		if size > uint64(len(value)) {
+			return syscall.EINVAL
+		}
+		value = value[:size]
+
+		if _, err := client.Write(n.state.fullPath(n.name), value); err != nil {
+			return toErrno(err)
+		}
+	}
+
+	_, errno := n.state.stat(n.name, &out.Attr)
+	return errno
+}
+
+func (n *xsNode) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	// Values can change at any time so bypass the page cache
+	return nil, fuse.FOPEN_DIRECT_IO, fusefs.OK
+}
+
+func (n *xsNode) Read(ctx context.Context, f fusefs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	value, err := client.Read(n.state.fullPath(n.name))
+	if err != nil {
+		return nil, toErrno(err)
+	}
+
+	if off >= int64(len(value)) {
+		return fuse.ReadResultData(nil), fusefs.OK
+	}
+
+	end := off + int64(len(dest))
+	if end > int64(len(value)) {
+		end = int64(len(value))
+	}
+
+	return fuse.ReadResultData([]byte(value[off:end])), fusefs.OK
+}
+
+func (n *xsNode) Write(ctx context.Context, f fusefs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	p := n.state.fullPath(n.name)
+
+	value, err := client.Read(p)
+	if err != nil {
+		return 0, toErrno(err)
+	}
+
+	// As in Setattr, a gap would have to be padded with NUL bytes which would not
+	// survive being read back, so writes may only start within or at the end of
+	// the value
+	if off > int64(len(value)) {
+		return 0, syscall.EINVAL
+	}
+
+	buf := []byte(value)
+	if end := int(off) + len(data); end > len(buf) {
+		buf = append(buf, make([]byte, end-len(buf))...)
+	}
+	copy(buf[off:], data)
+
+	if _, err := client.Write(p, string(buf)); err != nil {
+		return 0, toErrno(err)
+	}
+
+	return uint32(len(data)), fusefs.OK
+}
+
+func (n *xsNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+	if _, err := client.Write(n.state.fullPath(n.child(name)), ""); err != nil {
+		return nil, nil, 0, toErrno(err)
+	}
+
+	if _, errno := n.state.stat(n.child(name), &out.Attr); errno != fusefs.OK {
+		return nil, nil, 0, errno
+	}
+
+	return n.newChild(ctx, name, false), nil, fuse.FOPEN_DIRECT_IO, fusefs.OK
+}
+
+func (n *xsNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if _, err := client.Mkdir(n.state.fullPath(n.child(name))); err != nil {
+		return nil, toErrno(err)
+	}
+
+	n.state.setMkdir(n.child(name), true)
+
+	if _, errno := n.state.stat(n.child(name), &out.Attr); errno != fusefs.OK {
+		return nil, errno
+	}
+
+	return n.newChild(ctx, name, true), fusefs.OK
+}
+
+func (n *xsNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	if _, err := client.Remove(n.state.fullPath(n.child(name))); err != nil {
+		return toErrno(err)
+	}
+
+	return fusefs.OK
+}
+
+func (n *xsNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if _, err := client.Remove(n.state.fullPath(n.child(name))); err != nil {
+		return toErrno(err)
+	}
+
+	n.state.setMkdir(n.child(name), false)
+
+	return fusefs.OK
+}
+
+// invalidate tells the kernel to forget anything it has cached about the node at the
+// XenStore path p, so that changes made outside of the mount are seen.
+func invalidate(root *fusefs.Inode, rootPath, p string) {
+	if p != rootPath && !strings.HasPrefix(p, strings.TrimSuffix(rootPath, "/")+"/") {
+		return
+	}
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, rootPath), "/")
+
+	parent := root
+	for _, part := range strings.Split(rel, "/") {
+		if part == "" {
+			continue
+		}
+
+		parent.NotifyEntry(part)
+
+		child := parent.GetChild(part)
+		if child == nil {
+			return
+		}
+
+		child.NotifyContent(0, 0)
+		parent = child
+	}
+}
+
+func MountCommand(ctx context.Context, cmd *cli.Command) error {
+	mountpoint := cmd.Args().First()
+	if mountpoint == "" {
+		return cli.Exit("Please specify the directory to mount XenStore on", 3)
+	}
+
+	root := cmd.Args().Get(1)
+	if root == "" {
+		root = "/"
+	}
+
+	state := &mountState{
+		root: root,
+		fsys: client.FS(root),
+		dirs: map[string]bool{},
+	}
+
+	rootNode := &xsNode{state: state, name: "."}
+
+	timeout := time.Second
+	server, err := fusefs.Mount(mountpoint, rootNode, &fusefs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther: cmd.Bool("allow-other"),
+			Debug:      cmd.Bool("debug"),
+			FsName:     "xenstore:" + root,
+			Name:       "xenstore",
+		},
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+	})
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
+
+	events, err := client.Watch(root, mountWatchToken)
+	if err != nil {
+		server.Unmount()
+		return cli.Exit(err.Error(), 2)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		log.Debugf("Got signal %s, unmounting", sig)
+
+		if err := server.Unmount(); err != nil {
+			log.Errorf("Failed to unmount %s: %s", mountpoint, err)
+		}
+	}()
+
+	go func() {
+		for rsp := range events {
+			if rsp.Header.Op != xenstore.XsWatchEvent {
+				continue
+			}
+
+			invalidate(&rootNode.Inode, root, rsp.Strings()[0])
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "Mounted %s on %s, press Ctrl-C to unmount\n", root, mountpoint)
+	server.Wait()
+
+	return client.UnWatch(root, mountWatchToken)
+}
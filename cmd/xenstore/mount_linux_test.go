@@ -0,0 +1,218 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+// notifyRecorder stands in for the FUSE server, recording the invalidations sent to
+// the kernel.
+type notifyRecorder struct {
+	entries []string
+	inodes  []uint64
+}
+
+func (r *notifyRecorder) DeleteNotify(parent uint64, child uint64, name string) fuse.Status {
+	return fuse.OK
+}
+
+func (r *notifyRecorder) EntryNotify(parent uint64, name string) fuse.Status {
+	r.entries = append(r.entries, name)
+	return fuse.OK
+}
+
+func (r *notifyRecorder) InodeNotify(node uint64, off int64, length int64) fuse.Status {
+	r.inodes = append(r.inodes, node)
+	return fuse.OK
+}
+
+func (r *notifyRecorder) InodeRetrieveCache(node uint64, offset int64, dest []byte) (int, fuse.Status) {
+	return 0, fuse.OK
+}
+
+func (r *notifyRecorder) InodeNotifyStoreCache(node uint64, offset int64, data []byte) fuse.Status {
+	return fuse.OK
+}
+
+// newTestMount connects the global client to an in-memory store holding a small tree
+// & returns the root node of a mount of /local/domain/1, without mounting it.
+func newTestMount(t *testing.T) (*xsNode, *notifyRecorder) {
+	t.Helper()
+
+	client = xenstoretest.NewMemoryStore().Client()
+	t.Cleanup(func() {
+		client.Close()
+		client = nil
+	})
+
+	for p, value := range map[string]string{
+		"/local/domain/1/name":     "guest",
+		"/local/domain/1/data/key": "value",
+	} {
+		if _, err := client.Write(p, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := &xsNode{
+		state: &mountState{
+			root: "/local/domain/1",
+			fsys: client.FS("/local/domain/1"),
+			dirs: map[string]bool{},
+		},
+		name: ".",
+	}
+
+	notify := &notifyRecorder{}
+	fusefs.NewNodeFS(root, &fusefs.Options{ServerCallbacks: notify})
+
+	return root, notify
+}
+
+// lookup looks up name below parent & adds it to the tree, as the FUSE server does.
+func lookup(t *testing.T, parent *xsNode, name string) (*xsNode, *fuse.EntryOut) {
+	t.Helper()
+
+	out := &fuse.EntryOut{}
+	inode, errno := parent.Lookup(context.Background(), name, out)
+	if errno != fusefs.OK {
+		t.Fatalf("looking up %s: %s", name, errno)
+	}
+
+	parent.AddChild(name, inode, false)
+
+	return inode.Operations().(*xsNode), out
+}
+
+func TestMountLookup(t *testing.T) {
+	root, _ := newTestMount(t)
+
+	_, out := lookup(t, root, "name")
+	assert.Equal(t, uint32(fuse.S_IFREG|0644), out.Attr.Mode)
+	assert.Equal(t, uint64(len("guest")), out.Attr.Size)
+
+	_, out = lookup(t, root, "data")
+	assert.Equal(t, uint32(fuse.S_IFDIR|0755), out.Attr.Mode)
+
+	_, errno := root.Lookup(context.Background(), "missing", &fuse.EntryOut{})
+	assert.Equal(t, syscall.ENOENT, errno)
+}
+
+func TestMountReaddir(t *testing.T) {
+	root, _ := newTestMount(t)
+
+	stream, errno := root.Readdir(context.Background())
+	if errno != fusefs.OK {
+		t.Fatal(errno)
+	}
+
+	entries := map[string]uint32{}
+	for stream.HasNext() {
+		entry, errno := stream.Next()
+		assert.Equal(t, fusefs.OK, errno)
+		entries[entry.Name] = entry.Mode
+	}
+
+	assert.Equal(t, map[string]uint32{
+		"name": fuse.S_IFREG,
+		"data": fuse.S_IFDIR,
+	}, entries)
+}
+
+func TestMountReadWrite(t *testing.T) {
+	root, _ := newTestMount(t)
+	node, _ := lookup(t, root, "name")
+	ctx := context.Background()
+
+	read := func(off int64, size int) string {
+		t.Helper()
+
+		result, errno := node.Read(ctx, nil, make([]byte, size), off)
+		if errno != fusefs.OK {
+			t.Fatal(errno)
+		}
+
+		data, status := result.Bytes(make([]byte, size))
+		assert.Equal(t, fuse.OK, status)
+		return string(data)
+	}
+
+	assert.Equal(t, "guest", read(0, 64))
+	assert.Equal(t, "es", read(2, 2))
+	assert.Equal(t, "", read(10, 64))
+
+	n, errno := node.Write(ctx, nil, []byte("ST"), 3)
+	assert.Equal(t, fusefs.OK, errno)
+	assert.Equal(t, uint32(2), n)
+
+	_, errno = node.Write(ctx, nil, []byte("-1"), 5)
+	assert.Equal(t, fusefs.OK, errno)
+
+	value, err := client.Read("/local/domain/1/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "gueST-1", value)
+
+	// Writing past the end would leave a gap of NUL bytes
+	_, errno = node.Write(ctx, nil, []byte("x"), 10)
+	assert.Equal(t, syscall.EINVAL, errno)
+
+	value, err = client.Read("/local/domain/1/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "gueST-1", value)
+}
+
+func TestMountSetattr(t *testing.T) {
+	root, _ := newTestMount(t)
+	node, _ := lookup(t, root, "name")
+	ctx := context.Background()
+
+	truncate := func(size uint64) syscall.Errno {
+		in := &fuse.SetAttrIn{}
+		in.Valid = fuse.FATTR_SIZE
+		in.Size = size
+
+		return node.Setattr(ctx, nil, in, &fuse.AttrOut{})
+	}
+
+	assert.Equal(t, fusefs.OK, truncate(2))
+
+	value, err := client.Read("/local/domain/1/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "gu", value)
+
+	// Extending would need NUL padding, which XenStore cannot store
+	assert.Equal(t, syscall.EINVAL, truncate(10))
+
+	value, err = client.Read("/local/domain/1/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "gu", value)
+}
+
+func TestMountInvalidate(t *testing.T) {
+	root, notify := newTestMount(t)
+	data, _ := lookup(t, root, "data")
+	lookup(t, data, "key")
+
+	invalidate(&root.Inode, "/local/domain/1", "/local/domain/1/data/key")
+	assert.Equal(t, []string{"data", "key"}, notify.entries)
+	assert.Len(t, notify.inodes, 2)
+
+	// Nodes which the kernel has not looked up are skipped
+	notify.entries, notify.inodes = nil, nil
+	invalidate(&root.Inode, "/local/domain/1", "/local/domain/1/other/key")
+	assert.Equal(t, []string{"other"}, notify.entries)
+	assert.Empty(t, notify.inodes)
+
+	// As are paths outside of the mount
+	notify.entries = nil
+	invalidate(&root.Inode, "/local/domain/1", "/local/domain/10/name")
+	assert.Empty(t, notify.entries)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+
+	"github.com/urfave/cli/v3"
+)
+
+func MountCommand(ctx context.Context, cmd *cli.Command) error {
+	return cli.Exit("Mounting XenStore is only supported on Linux", 2)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/urfave/cli/v3"
+)
+
+// The formats accepted by the global --output flag. In the json format each command
+// prints a single JSON document, or an array for commands which print a list or are
+// given paths, even if only one path was given. The ndjson format prints one compact
+// JSON object per line, with one line for each item of a list. Commands which stream
+// results, such as watch, print one document for each result in either format.
+const (
+	outputText   = "text"
+	outputJSON   = "json"
+	outputNDJSON = "ndjson"
+)
+
+// output is the format selected using the --output flag.
+var output = outputText
+
+func setOutputFormat(format string) error {
+	switch format {
+	case outputText, outputJSON, outputNDJSON:
+		output = format
+		return nil
+	}
+
+	return fmt.Errorf("unknown output format %q, expected text, json or ndjson", format)
+}
+
+// errorResult is printed in place of a command's usual output when it fails.
+type errorResult struct {
+	Error string `json:"error"`
+	// Errno is the name of the errno returned by XenStore, e.g. ENOENT.
+	Errno string `json:"errno,omitempty"`
+	Op    string `json:"op,omitempty"`
+	Path  string `json:"path,omitempty"`
+}
+
+func newErrorResult(err error) errorResult {
+	result := errorResult{
+		Error: err.Error(),
+		Errno: xenstore.ErrorName(err),
+	}
+
+	var opErr *xenstore.OpError
+	if errors.As(err, &opErr) {
+		result.Op = opErr.Op
+		result.Path = opErr.Path
+	}
+
+	return result
+}
+
+// fail returns the error to exit with when a command fails with err, first printing
+// the error in the selected output format.
+func fail(err error) error {
+	if output == outputText {
+		return cli.Exit(err.Error(), 2)
+	}
+
+	printResult(newErrorResult(err), nil)
+	return cli.Exit("", 2)
+}
+
+// printResult prints a single result in the selected output format, calling text to
+// print it when the text format is selected.
+func printResult(v interface{}, text func()) {
+	enc := json.NewEncoder(os.Stdout)
+
+	switch output {
+	case outputJSON:
+		enc.SetIndent("", "  ")
+	case outputNDJSON:
+	default:
+		text()
+		return
+	}
+
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// printResults prints a list of results in the selected output format, calling text
+// to print them when the text format is selected.
+func printResults[T any](items []T, text func()) {
+	switch output {
+	case outputJSON:
+		if items == nil {
+			items = []T{}
+		}
+		printResult(items, nil)
+	case outputNDJSON:
+		for _, item := range items {
+			printResult(item, nil)
+		}
+	default:
+		text()
+	}
+}
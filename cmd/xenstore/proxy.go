@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+// proxyFlags are the flags accepted by the proxy command.
+var proxyFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "listen",
+		Value: "127.0.0.1:8740",
+		Usage: "Address to listen on",
+	},
+	&cli.StringSliceFlag{
+		Name:  "allow-path",
+		Usage: "Only allow access to paths matching this pattern, e.g. /local/domain/*/name, denying operations without a path unless given with --allow-op (may be repeated)",
+	},
+	&cli.StringSliceFlag{
+		Name:  "allow-op",
+		Usage: "Only allow this operation, e.g. read, directory or watch (may be repeated)",
+	},
+	&cli.StringFlag{
+		Name:  "server-cert",
+		Usage: "PEM file of the certificate to serve TLS with",
+	},
+	&cli.StringFlag{
+		Name:  "server-key",
+		Usage: "PEM file of the key for --server-cert",
+	},
+	&cli.StringFlag{
+		Name:  "client-ca",
+		Usage: "PEM file of the CA certificates which clients must present a certificate from (requires --server-cert)",
+	},
+	&cli.BoolFlag{
+		Name:  "insecure",
+		Usage: "Serve the whole of xenstore to anyone who can connect, without --client-ca, --allow-path or --allow-op",
+	},
+}
+
+func ProxyCommand(ctx context.Context, cmd *cli.Command) error {
+	if cmd.IsSet("connect") || cmd.IsSet("capture") {
+		return cli.Exit("The proxy serves the local xenstore, so --connect and --capture cannot be used with it", 3)
+	}
+
+	// Each client gets its own connection to the local xenstore
+	cfg := xenstore.ProxyConfig{
+		Dial: func() (xenstore.Transport, error) {
+			return getTransport(cmd)
+		},
+		AllowOps:   cmd.StringSlice("allow-op"),
+		AllowPaths: cmd.StringSlice("allow-path"),
+	}
+
+	if len(cfg.AllowOps) == 0 {
+		cfg.AllowOps = nil
+	}
+	if len(cfg.AllowPaths) == 0 {
+		cfg.AllowPaths = nil
+	}
+
+	// Without any of these every local user could use the proxy to get around the
+	// permissions on the xenstored socket, so that has to be asked for explicitly
+	if !cmd.IsSet("client-ca") && cfg.AllowOps == nil && cfg.AllowPaths == nil && !cmd.Bool("insecure") {
+		return cli.Exit("Refusing to serve xenstore without --client-ca, --allow-path or --allow-op, use --insecure to allow this", 3)
+	}
+
+	proxy, err := xenstore.NewProxy(cfg)
+	if err != nil {
+		return cli.Exit(err.Error(), 3)
+	}
+
+	l, err := net.Listen("tcp", cmd.String("listen"))
+	if err != nil {
+		return fail(err)
+	}
+
+	if cmd.IsSet("server-cert") {
+		config, err := loadTLSConfig(cmd.String("server-cert"), cmd.String("server-key"))
+		if err == nil {
+			config.ClientCAs, err = loadCertPool(cmd.String("client-ca"))
+		}
+		if err != nil {
+			l.Close()
+			return cli.Exit(err.Error(), 3)
+		}
+
+		if config.ClientCAs != nil {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		l = tls.NewListener(l, config)
+	} else if cmd.IsSet("client-ca") {
+		l.Close()
+		return cli.Exit("--client-ca requires --server-cert", 3)
+	}
+
+	log.Infof("Proxying xenstore on %s", l.Addr())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	go func() {
+		<-sigs
+		proxy.Close()
+	}()
+
+	if err := proxy.Serve(l); !errors.Is(err, xenstore.ErrProxyClosed) {
+		return fail(err)
+	}
+
+	return nil
+}
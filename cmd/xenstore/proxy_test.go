@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v3"
+)
+
+func TestProxyCommandRequiresRestriction(t *testing.T) {
+	cmd := &cli.Command{
+		Name:   "proxy",
+		Flags:  proxyFlags,
+		Action: ProxyCommand,
+		// Return the error rather than exiting
+		ExitErrHandler: func(context.Context, *cli.Command, error) {},
+	}
+
+	err := cmd.Run(context.Background(), []string{"proxy", "--listen", "127.0.0.1:0"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "--insecure")
+		var exitErr cli.ExitCoder
+		if assert.ErrorAs(t, err, &exitErr) {
+			assert.Equal(t, 3, exitErr.ExitCode())
+		}
+	}
+}
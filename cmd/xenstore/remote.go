@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/urfave/cli/v3"
+)
+
+// remoteFlags are the global flags for connecting to xenstore on another host through
+// the proxy command.
+var remoteFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "connect",
+		Usage: "Connect to a xenstore proxy at host:port instead of the local xenstore",
+	},
+	&cli.DurationFlag{
+		Name:  "connect-timeout",
+		Value: 10 * time.Second,
+		Usage: "Maximum time to wait when connecting to a xenstore proxy",
+	},
+	&cli.BoolFlag{
+		Name:  "tls",
+		Usage: "Use TLS when connecting to a xenstore proxy (implied by the other --tls-* flags)",
+	},
+	&cli.StringFlag{
+		Name:  "tls-ca",
+		Usage: "PEM file of the CA certificates used to verify the xenstore proxy",
+	},
+	&cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "PEM file of the client certificate to present to the xenstore proxy",
+	},
+	&cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "PEM file of the key for --tls-cert",
+	},
+}
+
+// openTransport connects to the xenstore proxy given by --connect, or to the local
+// xenstore otherwise.
+func openTransport(cmd *cli.Command) (xenstore.Transport, error) {
+	addr := cmd.String("connect")
+	if addr == "" {
+		return getTransport(cmd)
+	}
+
+	dialer := &xenstore.TCPDialer{Timeout: cmd.Duration("connect-timeout")}
+
+	if cmd.Bool("tls") || cmd.IsSet("tls-ca") || cmd.IsSet("tls-cert") {
+		config, err := loadTLSConfig(cmd.String("tls-cert"), cmd.String("tls-key"))
+		if err != nil {
+			return nil, err
+		}
+
+		if config.RootCAs, err = loadCertPool(cmd.String("tls-ca")); err != nil {
+			return nil, err
+		}
+		dialer.TLSConfig = config
+	}
+
+	return dialer.Dial(addr)
+}
+
+// loadTLSConfig creates a TLS configuration presenting the certificate in certFile, if
+// given. The key is read from certFile too if keyFile is empty.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// loadCertPool reads the PEM encoded CA certificates in caFile, returning nil to use
+// the system roots if caFile is empty.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/term"
+)
+
+// shellWatchPrefix is prepended to the path being watched to build the token for
+// each watch created from the shell.
+const shellWatchPrefix = "xenstore-go-shell:"
+
+// store is the set of operations available both on the Client and within a
+// Transaction, so that commands work the same way in either.
+type store interface {
+	List(path string) ([]string, error)
+	Read(path string) (string, error)
+	ReadMany(paths []string) (map[string]string, map[string]error)
+	Write(path, value string) (string, error)
+	Remove(path string) (string, error)
+	Mkdir(path string) (string, error)
+	GetPermissions(path string) (string, error)
+	SetPermissions(path string, perms []string) (string, error)
+}
+
+type shellCommand struct {
+	usage string
+	help  string
+	run   func(s *shell, args []string) error
+}
+
+var shellCommands map[string]shellCommand
+
+func init() {
+	// Assigned in init as the help command refers back to the map
+	shellCommands = map[string]shellCommand{
+		"cd":      {"cd [path]", "Change the current path", (*shell).cd},
+		"pwd":     {"pwd", "Print the current path", (*shell).pwd},
+		"ls":      {"ls [-l] [path]", "List the children of a path", (*shell).ls},
+		"cat":     {"cat path...", "Print the values of paths", (*shell).cat},
+		"write":   {"write path value", "Write a value to a path", (*shell).write},
+		"rm":      {"rm path...", "Remove paths recursively", (*shell).rm},
+		"mkdir":   {"mkdir path...", "Create paths", (*shell).mkdir},
+		"perms":   {"perms path [perm...]", "Print or set the permissions of a path", (*shell).perms},
+		"watch":   {"watch [path]", "Print changes to a path in the background", (*shell).watch},
+		"unwatch": {"unwatch [path]", "Stop watching a path", (*shell).unwatch},
+		"begin":   {"begin", "Start a transaction", (*shell).begin},
+		"commit":  {"commit", "Commit the current transaction", (*shell).commit},
+		"abort":   {"abort", "Abort the current transaction", (*shell).abort},
+		"help":    {"help", "Show this help", (*shell).help},
+		"exit":    {"exit", "Leave the shell", nil},
+	}
+}
+
+type shell struct {
+	client *xenstore.Client
+	out    io.Writer
+	cwd    string
+	tx     *xenstore.Transaction
+
+	lock    sync.Mutex
+	watches map[string]bool
+}
+
+func newShell(c *xenstore.Client, out io.Writer) *shell {
+	return &shell{
+		client:  c,
+		out:     out,
+		cwd:     "/",
+		watches: map[string]bool{},
+	}
+}
+
+// store returns the current Transaction if there is one, otherwise the Client.
+func (s *shell) store() store {
+	if s.tx != nil {
+		return s.tx
+	}
+
+	return s.client
+}
+
+func (s *shell) prompt() string {
+	if s.tx != nil {
+		return fmt.Sprintf("xenstore:%s (transaction %d)> ", s.cwd, s.tx.ID())
+	}
+
+	return fmt.Sprintf("xenstore:%s> ", s.cwd)
+}
+
+// resolve converts a path given to a command into an absolute path, relative to the
+// current path unless it starts with "/".
+func (s *shell) resolve(p string) string {
+	if p == "" {
+		return s.cwd
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = s.cwd + "/" + p
+	}
+
+	return path.Clean(p)
+}
+
+// execute runs a single line of input, returning io.EOF when the shell should exit.
+func (s *shell) execute(line string) error {
+	args, err := splitShellArgs(line)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	command, ok := shellCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, try help", args[0])
+	}
+
+	if command.run == nil {
+		return io.EOF
+	}
+
+	return command.run(s, args[1:])
+}
+
+func (s *shell) cd(args []string) error {
+	target := "/"
+	if len(args) > 0 {
+		target = s.resolve(args[0])
+	}
+
+	if _, err := s.store().List(target); err != nil {
+		return err
+	}
+
+	s.cwd = target
+	return nil
+}
+
+func (s *shell) pwd(args []string) error {
+	fmt.Fprintln(s.out, s.cwd)
+	return nil
+}
+
+func (s *shell) ls(args []string) error {
+	long := len(args) > 0 && args[0] == "-l"
+	if long {
+		args = args[1:]
+	}
+
+	dir := s.cwd
+	if len(args) > 0 {
+		dir = s.resolve(args[0])
+	}
+
+	children, err := s.store().List(dir)
+	if err != nil {
+		return err
+	}
+	sort.Strings(children)
+
+	for _, child := range children {
+		if !long {
+			fmt.Fprintln(s.out, child)
+			continue
+		}
+
+		fullpath := xenstore.JoinXenStorePath(dir, child)
+
+		perms, err := s.store().GetPermissions(fullpath)
+		if err != nil {
+			return err
+		}
+
+		value, err := s.store().Read(fullpath)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(s.out, "%s = %q (%s)\n", child, value, strings.ReplaceAll(perms, "\x00", ","))
+	}
+
+	return nil
+}
+
+func (s *shell) cat(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: " + shellCommands["cat"].usage)
+	}
+
+	for _, arg := range args {
+		value, err := s.store().Read(s.resolve(arg))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(s.out, value)
+	}
+
+	return nil
+}
+
+func (s *shell) write(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: " + shellCommands["write"].usage)
+	}
+
+	_, err := s.store().Write(s.resolve(args[0]), args[1])
+	return err
+}
+
+func (s *shell) rm(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: " + shellCommands["rm"].usage)
+	}
+
+	for _, arg := range args {
+		if _, err := s.store().Remove(s.resolve(arg)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *shell) mkdir(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: " + shellCommands["mkdir"].usage)
+	}
+
+	for _, arg := range args {
+		if _, err := s.store().Mkdir(s.resolve(arg)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *shell) perms(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: " + shellCommands["perms"].usage)
+	}
+
+	target := s.resolve(args[0])
+
+	if len(args) > 1 {
+		if !xenstore.ValidPermissions(args[1:]...) {
+			return fmt.Errorf("invalid permissions %s", strings.Join(args[1:], " "))
+		}
+
+		_, err := s.store().SetPermissions(target, args[1:])
+		return err
+	}
+
+	perms, err := s.store().GetPermissions(target)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(s.out, strings.ReplaceAll(perms, "\x00", " "))
+	return nil
+}
+
+func (s *shell) watch(args []string) error {
+	target := s.cwd
+	if len(args) > 0 {
+		target = s.resolve(args[0])
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.watches[target] {
+		return fmt.Errorf("already watching %s", target)
+	}
+
+	ch, err := s.client.Watch(target, shellWatchPrefix+target)
+	if err != nil {
+		return err
+	}
+	s.watches[target] = true
+
+	go func() {
+		for rsp := range ch {
+			if rsp.Header.Op != xenstore.XsWatchEvent {
+				continue
+			}
+
+			fmt.Fprintf(s.out, "watch %s: %s changed\n", target, rsp.Strings()[0])
+		}
+	}()
+
+	return nil
+}
+
+func (s *shell) unwatch(args []string) error {
+	target := s.cwd
+	if len(args) > 0 {
+		target = s.resolve(args[0])
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.watches[target] {
+		return fmt.Errorf("not watching %s", target)
+	}
+
+	delete(s.watches, target)
+	return s.client.UnWatch(target, shellWatchPrefix+target)
+}
+
+// close aborts any Transaction left in progress & removes all of the watches created
+// from the shell.
+func (s *shell) close() {
+	if s.tx != nil {
+		if err := s.abort(nil); err != nil {
+			fmt.Fprintf(s.out, "Failed to abort transaction: %s\n", err)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for target := range s.watches {
+		if err := s.client.UnWatch(target, shellWatchPrefix+target); err != nil {
+			fmt.Fprintf(s.out, "Failed to remove watch on %s: %s\n", target, err)
+		}
+		delete(s.watches, target)
+	}
+}
+
+func (s *shell) begin(args []string) error {
+	if s.tx != nil {
+		return fmt.Errorf("transaction %d is already in progress", s.tx.ID())
+	}
+
+	tx, err := s.client.StartTransaction()
+	if err != nil {
+		return err
+	}
+
+	s.tx = tx
+	return nil
+}
+
+func (s *shell) commit(args []string) error {
+	return s.end(true)
+}
+
+func (s *shell) abort(args []string) error {
+	return s.end(false)
+}
+
+func (s *shell) end(commit bool) error {
+	if s.tx == nil {
+		return errors.New("no transaction in progress")
+	}
+
+	tx := s.tx
+	s.tx = nil
+
+	if commit {
+		return tx.Commit()
+	}
+
+	return tx.Abort()
+}
+
+func (s *shell) help(args []string) error {
+	names := make([]string, 0, len(shellCommands))
+	for name := range shellCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(s.out, "  %-22s %s\n", shellCommands[name].usage, shellCommands[name].help)
+	}
+
+	return nil
+}
+
+// complete implements term.Terminal.AutoCompleteCallback, completing command names
+// and then the path segments of their arguments when tab is pressed.
+func (s *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	start := strings.LastIndexAny(line[:pos], " \t") + 1
+	word := line[start:pos]
+
+	var candidates []string
+	var prefix string
+
+	if strings.TrimSpace(line[:start]) == "" {
+		for name := range shellCommands {
+			candidates = append(candidates, name)
+		}
+		prefix = word
+	} else {
+		dir, base := s.cwd, word
+		if i := strings.LastIndex(word, "/"); i >= 0 {
+			dir = s.resolve(word[:i+1])
+			base = word[i+1:]
+		}
+
+		children, err := s.store().List(dir)
+		if err != nil {
+			return "", 0, false
+		}
+
+		candidates = children
+		prefix = base
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+
+	completion := commonPrefix(matches)[len(prefix):]
+	if completion == "" {
+		if len(matches) > 1 {
+			fmt.Fprintln(s.out, strings.Join(matches, "  "))
+		}
+		return "", 0, false
+	}
+
+	return line[:pos] + completion + line[pos:], pos + len(completion), true
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	return prefix
+}
+
+// splitShellArgs splits a line into words on whitespace. Single & double quotes group
+// words containing whitespace, and a backslash escapes the next character outside of
+// single quotes.
+func splitShellArgs(line string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	var inWord bool
+	var quote rune
+	var escaped bool
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+
+	if inWord {
+		args = append(args, word.String())
+	}
+
+	return args, nil
+}
+
+func ShellCommand(ctx context.Context, cmd *cli.Command) error {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		// Read commands from a script or pipe without prompting
+		s := newShell(client, os.Stdout)
+		defer s.close()
+
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if err := s.execute(scanner.Text()); err == io.EOF {
+				break
+			} else if err != nil {
+				return cli.Exit(err.Error(), 2)
+			}
+		}
+
+		return scanner.Err()
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
+	defer term.Restore(fd, state)
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+
+	s := newShell(client, terminal)
+	defer s.close()
+
+	terminal.AutoCompleteCallback = s.complete
+
+	for {
+		terminal.SetPrompt(s.prompt())
+
+		line, err := terminal.ReadLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return cli.Exit(err.Error(), 2)
+		}
+
+		if err := s.execute(line); err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Fprintln(terminal, "error:", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitShellArgs(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected []string
+		err      bool
+	}{
+		{line: "", expected: nil},
+		{line: "  \t ", expected: nil},
+		{line: "ls", expected: []string{"ls"}},
+		{line: "  write  a\tb  ", expected: []string{"write", "a", "b"}},
+		{line: `write a "two words"`, expected: []string{"write", "a", "two words"}},
+		{line: `write a 'two words'`, expected: []string{"write", "a", "two words"}},
+		{line: `write a ""`, expected: []string{"write", "a", ""}},
+		{line: `write a ''`, expected: []string{"write", "a", ""}},
+		{line: `write a"b"c`, expected: []string{"write", "abc"}},
+		{line: `write a two\ words`, expected: []string{"write", "a", "two words"}},
+		{line: `write a "say \"hi\""`, expected: []string{"write", "a", `say "hi"`}},
+		{line: `write a 'back\slash'`, expected: []string{"write", "a", `back\slash`}},
+		{line: `write a "it's"`, expected: []string{"write", "a", "it's"}},
+		{line: `write a \\`, expected: []string{"write", "a", `\`}},
+		{line: `write a "open`, err: true},
+		{line: `write a 'open`, err: true},
+		{line: `write a \`, err: true},
+	}
+
+	for _, test := range tests {
+		args, err := splitShellArgs(test.line)
+		if test.err {
+			assert.Error(t, err, test.line)
+			continue
+		}
+
+		if assert.NoError(t, err, test.line) {
+			assert.Equal(t, test.expected, args, test.line)
+		}
+	}
+}
+
+func TestShellResolve(t *testing.T) {
+	tests := []struct {
+		cwd      string
+		path     string
+		expected string
+	}{
+		{cwd: "/", path: "", expected: "/"},
+		{cwd: "/local/domain", path: "", expected: "/local/domain"},
+		{cwd: "/local/domain", path: ".", expected: "/local/domain"},
+		{cwd: "/local/domain", path: "..", expected: "/local"},
+		{cwd: "/local/domain", path: "../..", expected: "/"},
+		{cwd: "/local/domain", path: "../../..", expected: "/"},
+		{cwd: "/local/domain", path: "1/name", expected: "/local/domain/1/name"},
+		{cwd: "/local/domain", path: "./1/../2/", expected: "/local/domain/2"},
+		{cwd: "/local/domain", path: "/vm", expected: "/vm"},
+		{cwd: "/local/domain", path: "/vm/../tool//", expected: "/tool"},
+		{cwd: "/", path: "local", expected: "/local"},
+	}
+
+	for _, test := range tests {
+		s := newShell(nil, nil)
+		s.cwd = test.cwd
+
+		assert.Equal(t, test.expected, s.resolve(test.path), "%s in %s", test.path, test.cwd)
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	for _, p := range []string{
+		"/local/domain/1/name",
+		"/local/domain/1/device",
+		"/local/domain/1/data",
+		"/local/domain/2/name",
+	} {
+		if _, err := c.Write(p, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		cwd      string
+		line     string
+		pos      int
+		expected string
+		ok       bool
+		printed  string
+	}{
+		// Commands
+		{cwd: "/", line: "pw", expected: "pwd", ok: true},
+		{cwd: "/", line: "  mk", expected: "  mkdir", ok: true},
+		{cwd: "/", line: "u", expected: "unwatch", ok: true},
+		{cwd: "/", line: "c", printed: "cat  cd  commit\n"},
+		{cwd: "/", line: "nope"},
+		// Paths relative to the current path
+		{cwd: "/local/domain/1", line: "cat n", expected: "cat name", ok: true},
+		{cwd: "/local/domain/1", line: "cat de", expected: "cat device", ok: true},
+		{cwd: "/local/domain/1", line: "cat d", printed: "data  device\n"},
+		{cwd: "/local/domain/1", line: "cat x"},
+		{cwd: "/local/domain", line: "ls 1/na", expected: "ls 1/name", ok: true},
+		{cwd: "/local/domain/1", line: "ls ../2/n", expected: "ls ../2/name", ok: true},
+		// Absolute paths
+		{cwd: "/", line: "ls /lo", expected: "ls /local", ok: true},
+		{cwd: "/vm", line: "ls /local/domain/2/", expected: "ls /local/domain/2/name", ok: true},
+		// Missing parents have nothing to complete
+		{cwd: "/", line: "ls /missing/a"},
+		// Only the word before the cursor is completed
+		{cwd: "/local/domain/1", line: "write na value", pos: 8, expected: "write name value", ok: true},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		s := newShell(c, &out)
+		s.cwd = test.cwd
+
+		pos := test.pos
+		if pos == 0 {
+			pos = len(test.line)
+		}
+
+		line, newPos, ok := s.complete(test.line, pos, '\t')
+		assert.Equal(t, test.ok, ok, test.line)
+		assert.Equal(t, test.printed, out.String(), test.line)
+		if test.ok {
+			assert.Equal(t, test.expected, line, test.line)
+			assert.Equal(t, pos+len(test.expected)-len(test.line), newPos, test.line)
+		}
+	}
+
+	// Only tab completes
+	_, _, ok := newShell(c, &bytes.Buffer{}).complete("pw", 2, 'a')
+	assert.False(t, ok)
+}
@@ -1,30 +1,17 @@
-//go:build !windows
-
 package main
 
 import (
 	"github.com/joelnb/xenstore-go"
-	"github.com/urfave/cli/v3"
+	log "github.com/sirupsen/logrus"
 )
 
-func getTransport(cmd *cli.Command) (xenstore.Transport, error) {
-	if cmd.Bool("use-socket") {
-		var sockPath string
-		if cmd.IsSet("socket-path") {
-			sockPath = cmd.String("socket-path")
-		} else {
-			sockPath = xenstore.UnixSocketPath()
-		}
-
-		return xenstore.NewUnixSocketTransport(sockPath)
-	} else {
-		var devPath string
-		if cmd.IsSet("xenbus-path") {
-			devPath = cmd.String("xenbus-path")
-		} else {
-			devPath = xenstore.XenBusPath()
-		}
-
-		return xenstore.NewXenBusTransport(devPath)
+// dialAuto picks the local transport using xenstore.DialAuto, logging each attempt.
+// It is used by getTransport when no transport is chosen using flags.
+func dialAuto() (xenstore.Transport, error) {
+	t, attempts, err := xenstore.DialAuto()
+	for _, attempt := range attempts {
+		log.Debugf("Connecting to xenstore using %s", attempt)
 	}
+
+	return t, err
 }
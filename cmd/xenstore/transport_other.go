@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"github.com/joelnb/xenstore-go"
+	"github.com/urfave/cli/v3"
+)
+
+func getTransport(cmd *cli.Command) (xenstore.Transport, error) {
+	switch {
+	case cmd.Bool("use-socket") || cmd.Bool("read-only") || cmd.IsSet("socket-path"):
+		var sockPath string
+		if cmd.IsSet("socket-path") {
+			sockPath = cmd.String("socket-path")
+		} else if cmd.Bool("read-only") {
+			sockPath = xenstore.ReadOnlyUnixSocketPath()
+		} else {
+			sockPath = xenstore.UnixSocketPath()
+		}
+
+		return xenstore.NewUnixSocketTransport(sockPath)
+
+	case cmd.Bool("use-xenbus") || cmd.IsSet("xenbus-path"):
+		var devPath string
+		if cmd.IsSet("xenbus-path") {
+			devPath = cmd.String("xenbus-path")
+		} else {
+			devPath = xenstore.XenBusPath()
+		}
+
+		return xenstore.NewXenBusTransport(devPath)
+
+	default:
+		return dialAuto()
+	}
+}
@@ -8,5 +8,5 @@ import (
 )
 
 func getTransport(cmd *cli.Command) (xenstore.Transport, error) {
-	return xenstore.NewWinPVTransport()
+	return dialAuto()
 }
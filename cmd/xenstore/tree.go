@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/urfave/cli/v3"
+)
+
+// treeOptions controls the output of printTree.
+type treeOptions struct {
+	// perms adds the permissions of each node, like xenstore-ls -p
+	perms bool
+	// fullPath prints the full path of each node instead of indenting, like
+	// xenstore-ls -f
+	fullPath bool
+}
+
+// sanitiseValue escapes a value in the same way as sanitise_value in the C xs_lib, as
+// used by xenstore-ls, so that each value fits on a single line.
+func sanitiseValue(value string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		if c >= ' ' && c <= '~' && c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		b.WriteByte('\\')
+		switch c {
+		case '\t':
+			b.WriteByte('t')
+		case '\n':
+			b.WriteByte('n')
+		case '\r':
+			b.WriteByte('r')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			if c < 010 {
+				fmt.Fprintf(&b, "%03o", c)
+			} else {
+				fmt.Fprintf(&b, "x%02x", c)
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// treeNode is a single node found by walkTree, which is also its structured output.
+type treeNode struct {
+	Path string `json:"path"`
+	// Value is nil if the node could not be read.
+	Value *string  `json:"value"`
+	Perms []string `json:"perms,omitempty"`
+
+	name  string
+	depth int
+}
+
+// walkTree calls visit for every node below dir, parents before their children. The
+// values of all of the children of each node are read before visiting them.
+func walkTree(dir string, depth int, opts treeOptions, visit func(treeNode)) error {
+	children, err := client.List(dir)
+	if err != nil {
+		// Like xenstore-ls, skip over parts of the tree we are not allowed to see
+		if depth > 0 && errors.Is(err, xenstore.ErrPermission) {
+			return nil
+		}
+		return err
+	}
+	sort.Strings(children)
+
+	paths := make([]string, len(children))
+	for i, child := range children {
+		paths[i] = xenstore.JoinXenStorePath(dir, child)
+	}
+
+	values, errs := client.ReadMany(paths)
+
+	for i, child := range children {
+		node := treeNode{Path: paths[i], name: child, depth: depth}
+
+		if _, ok := errs[paths[i]]; !ok {
+			value := values[paths[i]]
+			node.Value = &value
+		}
+
+		if opts.perms {
+			perms, err := client.GetPermissions(paths[i])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not access permissions for %s: %s\n", child, err)
+			} else {
+				node.Perms = strings.Split(perms, "\x00")
+			}
+		}
+
+		visit(node)
+
+		if err := walkTree(paths[i], depth+1, opts, visit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// printTreeNode writes a node to w in the format used by xenstore-ls.
+func printTreeNode(w io.Writer, node treeNode, opts treeOptions) {
+	if opts.fullPath {
+		fmt.Fprint(w, node.Path)
+	} else {
+		fmt.Fprint(w, strings.Repeat(" ", node.depth), node.name)
+	}
+
+	if node.Value == nil {
+		fmt.Fprint(w, ":")
+	} else {
+		fmt.Fprintf(w, ` = "%s"`, sanitiseValue(*node.Value))
+	}
+
+	if node.Perms != nil {
+		fmt.Fprintf(w, "  (%s)", strings.Join(node.Perms, ","))
+	}
+
+	fmt.Fprintln(w)
+}
+
+func TreeCommand(ctx context.Context, cmd *cli.Command) error {
+	path := cmd.Args().First()
+	if path == "" {
+		path = "/"
+	}
+
+	opts := treeOptions{
+		perms:    cmd.Bool("perms"),
+		fullPath: cmd.Bool("full-path"),
+	}
+
+	var nodes []treeNode
+	err := walkTree(path, 0, opts, func(node treeNode) {
+		if output == outputText {
+			// Print as we go as the whole tree can take a while to read
+			printTreeNode(os.Stdout, node, opts)
+		} else {
+			nodes = append(nodes, node)
+		}
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	printResults(nodes, func() {})
+
+	return nil
+}
+
+// treeFlags are the flags accepted by every command which prints a tree.
+var treeFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:    "perms",
+		Aliases: []string{"p"},
+		Usage:   "Show the permissions of each node",
+	},
+	&cli.BoolFlag{
+		Name:    "full-path",
+		Aliases: []string{"f"},
+		Usage:   "Print the full path of each node instead of indenting",
+	},
+}
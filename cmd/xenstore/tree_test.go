@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitiseValue(t *testing.T) {
+	// The expected output is that of xenstore-ls
+	tests := map[string]string{
+		"":             "",
+		"plain value":  "plain value",
+		`\`:            `\\`,
+		`'`:            `'`,
+		`"`:            `"`,
+		"\t":           `\t`,
+		"\n":           `\n`,
+		"\r":           `\r`,
+		"\x00":         `\000`,
+		"\x01":         `\001`,
+		"\x07":         `\007`,
+		"\x08":         `\x08`,
+		"\x1b":         `\x1b`,
+		"\x7f":         `\x7f`,
+		"\xff":         `\xff`,
+		"a\\b\tc\x01d": `a\\b\tc\001d`,
+	}
+
+	for value, expected := range tests {
+		assert.Equal(t, expected, sanitiseValue(value), "%q", value)
+	}
+}
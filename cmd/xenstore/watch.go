@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+// watchResult is the structured output for each event received by WatchCommand.
+type watchResult struct {
+	Path  string `json:"path"`
+	Token string `json:"token"`
+	// Value is the value of Path after the change, or nil if it no longer exists or
+	// could not be read.
+	Value *string `json:"value"`
+	// Error is set if Path could not be read for any reason other than not existing.
+	Error string `json:"error,omitempty"`
+}
+
+// watchFlags are the flags accepted by the watch command.
+var watchFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "exec",
+		Usage: "Run a shell command for each event with XENSTORE_WATCH_PATH, XENSTORE_WATCH_VALUE, XENSTORE_WATCH_EXISTS and XENSTORE_WATCH_TOKEN set",
+	},
+	&cli.StringFlag{
+		Name:  "until-value",
+		Usage: "Exit once the watched path has this value",
+	},
+	&cli.BoolFlag{
+		Name:  "until-exists",
+		Usage: "Exit once the watched path exists",
+	},
+	&cli.DurationFlag{
+		Name:  "timeout",
+		Usage: "Stop watching after this long, failing if an --until condition has not been met",
+	},
+	&cli.IntFlag{
+		Name:  "depth",
+		Value: -1,
+		Usage: "Ignore events for paths more than this many levels below the watched path",
+	},
+}
+
+// watchToken generates a token which is unique to this process.
+func watchToken() string {
+	return fmt.Sprintf("xenstore-go-%d-%d", os.Getpid(), time.Now().UnixNano())
+}
+
+// watchDepth returns how many levels below the watched path p is.
+func watchDepth(watched, p string) int {
+	if p == watched {
+		return 0
+	}
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, watched), "/")
+	return strings.Count(rel, "/") + 1
+}
+
+// runWatchHook runs the --exec command for an event, waiting for it to finish.
+func runWatchHook(command string, result watchResult) error {
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.Command("cmd", "/C", command)
+	} else {
+		c = exec.Command("/bin/sh", "-c", command)
+	}
+
+	exists := "1"
+	value := ""
+	if result.Value != nil {
+		value = *result.Value
+	} else {
+		exists = "0"
+	}
+
+	c.Env = append(os.Environ(),
+		"XENSTORE_WATCH_PATH="+result.Path,
+		"XENSTORE_WATCH_VALUE="+value,
+		"XENSTORE_WATCH_EXISTS="+exists,
+		"XENSTORE_WATCH_TOKEN="+result.Token,
+	)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	return c.Run()
+}
+
+// queueEvents receives the packets sent to ch as soon as they arrive & delivers them
+// in order on the returned channel, which is closed after ch is. The Router blocks
+// until each event is received, so reading ch directly while also waiting for replies,
+// such as when reading the changed path, would deadlock once events queue up. The
+// goroutine exits early once stop is closed.
+func queueEvents(ch chan *xenstore.Packet, stop chan struct{}) <-chan *xenstore.Packet {
+	out := make(chan *xenstore.Packet)
+
+	go func() {
+		defer close(out)
+
+		var queue []*xenstore.Packet
+		for ch != nil || len(queue) > 0 {
+			var send chan *xenstore.Packet
+			var next *xenstore.Packet
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+
+			select {
+			case rsp, ok := <-ch:
+				if !ok {
+					ch = nil
+					continue
+				}
+				queue = append(queue, rsp)
+			case send <- next:
+				queue = queue[1:]
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+func WatchCommand(ctx context.Context, cmd *cli.Command) error {
+	path := cmd.Args().First()
+	if path == "" {
+		return cli.Exit("Please specify the XenStore path to watch", 3)
+	}
+
+	token := cmd.Args().Get(1)
+	if token == "" {
+		token = watchToken()
+	}
+
+	untilValue := cmd.IsSet("until-value")
+	untilExists := cmd.Bool("until-exists")
+	depth := cmd.Int("depth")
+
+	watch, err := client.Watch(path, token)
+	if err != nil {
+		return fail(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	ch := queueEvents(watch, stop)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	var timeout <-chan time.Time
+	if d := cmd.Duration("timeout"); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var watchErr error
+
+OUTER:
+	for {
+		select {
+		case rsp, ok := <-ch:
+			if !ok {
+				err := client.Error()
+				if err == nil {
+					err = xenstore.ErrConnectionLost
+				}
+				return fail(fmt.Errorf("watch closed: %w", err))
+			}
+
+			if err := rsp.Check(); err != nil {
+				watchErr = err
+				break OUTER
+			}
+
+			if rsp.Header.Op != xenstore.XsWatchEvent {
+				continue
+			}
+
+			result := watchResult{Path: rsp.Strings()[0], Token: token}
+			if depth >= 0 && watchDepth(path, result.Path) > depth {
+				continue
+			}
+
+			value, err := client.Read(result.Path)
+			switch {
+			case err == nil:
+				result.Value = &value
+			case !errors.Is(err, xenstore.ErrNotFound):
+				result.Error = err.Error()
+			}
+
+			printResult(result, func() {
+				switch {
+				case result.Error != "":
+					fmt.Fprintf(os.Stderr, "%s: failed to read: %s\n", result.Path, result.Error)
+				case result.Value == nil:
+					fmt.Printf("%s (removed)\n", result.Path)
+				default:
+					fmt.Printf("%s = \"%s\"\n", result.Path, sanitiseValue(*result.Value))
+				}
+			})
+
+			// The hook cannot be told whether the path exists
+			if result.Error != "" {
+				continue
+			}
+
+			if command := cmd.String("exec"); command != "" {
+				if err := runWatchHook(command, result); err != nil {
+					log.Warnf("Command for %s failed: %s", result.Path, err)
+				}
+			}
+
+			if result.Path == path && result.Value != nil &&
+				((untilValue && *result.Value == cmd.String("until-value")) || untilExists) {
+				break OUTER
+			}
+
+		case <-timeout:
+			if untilValue || untilExists {
+				watchErr = fmt.Errorf("timed out waiting for %s", path)
+			}
+			break OUTER
+
+		case sig := <-sigs:
+			log.Infof("Got signal %s, removing watch and exiting", sig)
+			break OUTER
+		}
+	}
+
+	if err := client.UnWatch(path, token); err != nil && watchErr == nil {
+		watchErr = err
+	}
+
+	if watchErr != nil {
+		return fail(watchErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v3"
+)
+
+func TestWatchCommandBurst(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	client = store.Client()
+	defer func() {
+		client.Close()
+		client = nil
+	}()
+
+	writer := store.Client()
+	defer writer.Close()
+
+	cmd := &cli.Command{Name: "watch", Flags: watchFlags, Action: WatchCommand}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Run(context.Background(), []string{"watch", "--until-value", "connected", "/local/domain/1/device/state"})
+	}()
+
+	// Many changes arrive while the command is still reading the value of the first
+	for i := 0; i < 50; i++ {
+		if _, err := writer.Write(fmt.Sprintf("/local/domain/1/device/state/%d", i), "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := writer.Write("/local/domain/1/device/state", "connected"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch did not see the value after a burst of events")
+	}
+}
@@ -0,0 +1,80 @@
+package xenstore
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Election chooses a single leader among cooperating clients, such as redundant
+// daemons in dom0 which must not act on the same domain at the same time. It is
+// built on a Lock stored below a path shared by all of the candidates: whichever
+// holds the Lock is the leader.
+type Election struct {
+	lock   *Lock
+	leader atomic.Bool
+}
+
+// NewElection returns an Election using a Lock stored below path. The options are
+// passed on to NewLock; WithLockOwner sets the identifier of this candidate.
+func NewElection(c *Client, path string, opts ...LockOption) *Election {
+	return &Election{lock: NewLock(c, path, opts...)}
+}
+
+// ID returns the identifier of this candidate, as reported by Leader.
+func (e *Election) ID() string {
+	return e.lock.Owner()
+}
+
+// IsLeader reports whether this candidate is currently the leader.
+func (e *Election) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Leader returns the identifier of the current leader, which may be another
+// candidate, or an empty string if there is none.
+func (e *Election) Leader() (string, error) {
+	return e.lock.Holder()
+}
+
+// Run takes part in the Election until ctx is done, calling onChange with true when
+// this candidate becomes the leader & with false when it stops being the leader. If
+// leadership is lost because the lease could not be renewed then Run carries on
+// campaigning to become the leader again. Once ctx is done leadership is given up &
+// ctx's error is returned; any other error stops Run straight away.
+//
+// onChange is called from the goroutine calling Run and should return promptly.
+func (e *Election) Run(ctx context.Context, onChange func(leader bool)) error {
+	for {
+		if err := e.lock.Lock(ctx); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+
+		e.setLeader(true, onChange)
+
+		select {
+		case <-e.lock.Lost():
+			e.setLeader(false, onChange)
+
+		case <-ctx.Done():
+			err := e.lock.Unlock()
+			e.setLeader(false, onChange)
+
+			if err != nil && !errors.Is(err, ErrLockNotHeld) {
+				return err
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+func (e *Election) setLeader(leader bool, onChange func(bool)) {
+	e.leader.Store(leader)
+
+	if onChange != nil {
+		onChange(leader)
+	}
+}
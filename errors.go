@@ -2,26 +2,132 @@ package xenstore
 
 import (
 	"errors"
+	"fmt"
 	"syscall"
 )
 
+var (
+	// ErrRouterStopped is returned when sending a request through a Router (or a
+	// Client) whose event loop has exited.
+	ErrRouterStopped = errors.New("router stopped")
+	// ErrConnectionLost is returned when the connection to XenStore fails before the
+	// reply to a request is received.
+	ErrConnectionLost = errors.New("connection to XenStore lost")
+	// ErrRequestTimeout is returned when XenStore does not reply to a request within
+	// the timeout configured using WithRequestTimeout.
+	ErrRequestTimeout = errors.New("request timed out")
+	// ErrPayloadTooLarge is wrapped by a FramingError when a packet header gives a
+	// payload length greater than MaxPayloadSize.
+	ErrPayloadTooLarge = errors.New("payload too large")
+	// ErrInvalidOperation is wrapped by a FramingError when a packet header contains
+	// an unknown operation.
+	ErrInvalidOperation = errors.New("invalid operation")
+)
+
+// FramingError is returned when a malformed packet is read from a Transport. The
+// stream cannot be resynchronised after this so the connection must be closed.
+type FramingError struct {
+	Header PacketHeader
+	Err    error
+}
+
+func (e *FramingError) Error() string {
+	return fmt.Sprintf("malformed packet (op=%d, rqid=%d, length=%d): %s",
+		uint32(e.Header.Op), e.Header.RqId, e.Header.Length, e.Err)
+}
+
+func (e *FramingError) Unwrap() error {
+	return e.Err
+}
+
+// Errors returned by XenStore. These can be compared against errors returned by the
+// Client using errors.Is. The standard io/fs errors (such as fs.ErrNotExist) can be
+// used in the same way where they apply.
+var (
+	// ErrInvalid is returned for malformed requests or paths.
+	ErrInvalid = syscall.EINVAL
+	// ErrPermission is returned when the connection is not allowed to access a path.
+	ErrPermission = syscall.EACCES
+	// ErrExists is returned when creating something which already exists.
+	ErrExists = syscall.EEXIST
+	// ErrNotFound is returned when a path does not exist.
+	ErrNotFound = syscall.ENOENT
+	// ErrQuotaExceeded is returned when a domain has used up its XenStore quota.
+	ErrQuotaExceeded = syscall.ENOSPC
+	// ErrNotSupported is returned for operations which XenStore does not implement.
+	ErrNotSupported = syscall.ENOSYS
+	// ErrReadOnly is returned when modifying XenStore over a read-only connection.
+	ErrReadOnly = syscall.EROFS
+	// ErrTransactionConflict is returned when committing a transaction which conflicts
+	// with changes made since it started. The transaction should be retried.
+	ErrTransactionConflict = syscall.EAGAIN
+)
+
 var xenStoreErrors = map[string]syscall.Errno{
-	"EINVAL":    syscall.EINVAL,
-	"EACCES":    syscall.EACCES,
-	"EEXIST":    syscall.EEXIST,
+	"EINVAL":    ErrInvalid,
+	"EACCES":    ErrPermission,
+	"EEXIST":    ErrExists,
 	"EISDIR":    syscall.EISDIR,
-	"ENOENT":    syscall.ENOENT,
+	"ENOENT":    ErrNotFound,
 	"ENOMEM":    syscall.ENOMEM,
-	"ENOSPC":    syscall.ENOSPC,
+	"ENOSPC":    ErrQuotaExceeded,
 	"EIO":       syscall.EIO,
 	"ENOTEMPTY": syscall.ENOTEMPTY,
-	"ENOSYS":    syscall.ENOSYS,
-	"EROFS":     syscall.EROFS,
+	"ENOSYS":    ErrNotSupported,
+	"EROFS":     ErrReadOnly,
 	"EBUSY":     syscall.EBUSY,
-	"EAGAIN":    syscall.EAGAIN,
+	"EAGAIN":    ErrTransactionConflict,
 	"EISCONN":   syscall.EISCONN,
 }
 
+// OpError is the error returned by the Client when an operation fails. It records
+// the operation and the path it was applied to alongside the underlying error, which
+// is usually a syscall.Errno returned by XenStore.
+type OpError struct {
+	// Op is the name of the operation, e.g. "read".
+	Op string
+	// Path is the path (or other argument) the operation was applied to.
+	Path string
+	// TxID is the transaction the operation was part of, or 0 if none.
+	TxID uint32
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *OpError) Error() string {
+	s := e.Op
+	if e.Path != "" {
+		s += " " + e.Path
+	}
+	if e.TxID != 0 {
+		s += fmt.Sprintf(" (transaction %d)", e.TxID)
+	}
+
+	return s + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// opError wraps err in an *OpError describing the request p.
+func opError(p *Packet, err error) error {
+	e := &OpError{
+		Op:   p.Header.Op.String(),
+		TxID: p.Header.TxId,
+		Err:  err,
+	}
+
+	switch p.Header.Op {
+	case XsStartTransaction, XsEndTransaction:
+		// The payload is not a path
+	default:
+		e.Path = p.Strings()[0]
+	}
+
+	return e
+}
+
 // Error converts a string returned from XenStore to the syscall error
 // it represents.
 func Error(s string) error {
@@ -31,3 +137,20 @@ func Error(s string) error {
 		return errors.New(s)
 	}
 }
+
+// ErrorName returns the name XenStore uses on the wire for the errno wrapped by err,
+// such as "ENOENT", or an empty string if err does not wrap one of those errnos.
+func ErrorName(err error) string {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return ""
+	}
+
+	for name, e := range xenStoreErrors {
+		if e == errno {
+			return name
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,58 @@
+package xenstore_test
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+	"testing"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpError(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	_, err := c.Read("/local/domain/5/name")
+
+	var opErr *OpError
+	if assert.True(t, errors.As(err, &opErr)) {
+		assert.Equal(t, "read", opErr.Op)
+		assert.Equal(t, "/local/domain/5/name", opErr.Path)
+		assert.Equal(t, uint32(0), opErr.TxID)
+	}
+
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.True(t, errors.Is(err, syscall.ENOENT))
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.Equal(t, "read /local/domain/5/name: no such file or directory", err.Error())
+
+	tx, err := c.StartTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Abort()
+
+	_, err = tx.SetPermissions("/local/domain/5/name", []string{"n0"})
+	assert.Equal(t, "set_perms /local/domain/5/name (transaction 1): no such file or directory", err.Error())
+}
+
+func TestError(t *testing.T) {
+	assert.Equal(t, ErrTransactionConflict, Error("EAGAIN"))
+	assert.True(t, errors.Is(Error("EACCES"), fs.ErrPermission))
+	assert.Equal(t, "something else", Error("something else").Error())
+}
+
+func TestErrorName(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	_, err := c.Read("/local/domain/5/name")
+	assert.Equal(t, "ENOENT", ErrorName(err))
+	assert.Equal(t, "EAGAIN", ErrorName(ErrTransactionConflict))
+	assert.Equal(t, "", ErrorName(syscall.ENOTDIR))
+	assert.Equal(t, "", ErrorName(ErrRequestTimeout))
+	assert.Equal(t, "", ErrorName(nil))
+}
@@ -0,0 +1,23 @@
+package xenstore
+
+// Exports of internals for the tests in package xenstore_test.
+
+const CaptureRecordHeaderSize = captureRecordHeaderSize
+
+var ExpandBraces = expandBraces
+
+// DeliverPacket passes a Packet received from the Transport to whichever channel is
+// waiting for it, as the receive loop started by Start does.
+func (r *Router) DeliverPacket(pkt *Packet) {
+	r.sendToChannel(pkt)
+}
+
+// WatchCount returns the number of watches the Client has registered.
+func (c *Client) WatchCount() int {
+	count := 0
+	for _, registrations := range c.router.watches() {
+		count += len(registrations)
+	}
+
+	return count
+}
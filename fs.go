@@ -0,0 +1,285 @@
+package xenstore
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FS returns a read-only fs.FS presenting the XenStore tree below root. Nodes which
+// have children are directories & all other nodes are files containing their value.
+// The Sys method of each fs.FileInfo returns the permissions of the node as a
+// []string, in the same format as SetPermissions accepts.
+//
+// The returned value also implements fs.ReadDirFS, fs.ReadFileFS and fs.StatFS so it
+// can be used directly with fs.WalkDir, fs.Glob and similar.
+func (c *Client) FS(root string) fs.FS {
+	return &xenStoreFS{client: c, root: root}
+}
+
+type xenStoreFS struct {
+	client *Client
+	root   string
+}
+
+// fileInfo implements fs.FileInfo for a XenStore node.
+type fileInfo struct {
+	name  string
+	value string
+	dir   bool
+	perms []string
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	if i.dir {
+		return 0
+	}
+
+	return int64(len(i.value))
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+
+	return 0444
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i *fileInfo) Sys() interface{} {
+	return i.perms
+}
+
+// fullPath converts a name within the FS to a XenStore path.
+func (f *xenStoreFS) fullPath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return f.root, nil
+	}
+
+	return JoinXenStorePath(f.root, name), nil
+}
+
+// statAll fetches the details of all of the named nodes, sending every request before
+// waiting for any of the replies. If skipMissing is set, nodes which do not exist are
+// left out of the result rather than failing it.
+func (f *xenStoreFS) statAll(op string, names []string, skipMissing bool) ([]*fileInfo, error) {
+	type pending struct {
+		pkt *Packet
+		ch  chan *Packet
+	}
+
+	requests := make([][3]pending, len(names))
+
+	for i, name := range names {
+		p, err := f.fullPath(op, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, reqOp := range []Operation{XsDirectory, XsRead, XsGetPermissions} {
+			pkt, ch, err := f.client.sendBytes(reqOp, append([]byte(p), NUL), 0x0)
+			if err != nil {
+				return nil, &fs.PathError{Op: op, Path: name, Err: err}
+			}
+
+			requests[i][j] = pending{pkt, ch}
+		}
+	}
+
+	infos := make([]*fileInfo, 0, len(names))
+
+	for i, name := range names {
+		var replies [3]*Packet
+		var firstErr error
+
+		// Wait for every reply, even after an error, so none are left to time out
+		for j, req := range requests[i] {
+			rsp, err := f.client.waitReply(req.pkt, req.ch)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			replies[j] = rsp
+		}
+
+		if skipMissing && errors.Is(firstErr, ErrNotFound) {
+			continue
+		}
+
+		if firstErr != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: firstErr}
+		}
+
+		base := path.Base(name)
+		if name == "." {
+			base = "."
+		}
+
+		infos = append(infos, &fileInfo{
+			name:  base,
+			dir:   replies[0].payloadString() != "",
+			value: replies[1].payloadString(),
+			perms: strings.Split(replies[2].payloadString(), "\x00"),
+		})
+	}
+
+	return infos, nil
+}
+
+// Stat implements fs.StatFS.
+func (f *xenStoreFS) Stat(name string) (fs.FileInfo, error) {
+	infos, err := f.statAll("stat", []string{name}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return infos[0], nil
+}
+
+// Open implements fs.FS.
+func (f *xenStoreFS) Open(name string) (fs.File, error) {
+	infos, err := f.statAll("open", []string{name}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if infos[0].dir {
+		return &dirFile{fs: f, name: name, info: infos[0]}, nil
+	}
+
+	return &valueFile{Reader: strings.NewReader(infos[0].value), info: infos[0]}, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (f *xenStoreFS) ReadFile(name string) ([]byte, error) {
+	infos, err := f.statAll("readfile", []string{name}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if infos[0].dir {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: syscall.EISDIR}
+	}
+
+	return []byte(infos[0].value), nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (f *xenStoreFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := f.fullPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	children, err := f.client.List(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	sort.Strings(children)
+
+	names := make([]string, len(children))
+	for i, child := range children {
+		names[i] = path.Join(name, child)
+	}
+
+	// Children removed since they were listed are left out, as they would have been
+	// had they been removed before it
+	infos, err := f.statAll("readdir", names, true)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+
+	return entries, nil
+}
+
+// valueFile is an open XenStore node without children.
+type valueFile struct {
+	*strings.Reader
+	info *fileInfo
+}
+
+func (f *valueFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *valueFile) Close() error {
+	return nil
+}
+
+// dirFile is an open XenStore node with children.
+type dirFile struct {
+	fs      *xenStoreFS
+	name    string
+	info    *fileInfo
+	entries []fs.DirEntry
+	loaded  bool
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.loaded {
+		entries, err := d.fs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+
+		d.entries = entries
+		d.loaded = true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,87 @@
+package xenstore_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFS(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	for path, value := range map[string]string{
+		"/local/domain/5/name":                   "guest",
+		"/local/domain/5/device/vif/0/state":     "4",
+		"/local/domain/5/device/vif/0/mac":       "00:16:3e:00:00:01",
+		"/local/domain/5/device/vif/1/state":     "1",
+		"/local/domain/5/control/shutdown":       "",
+		"/local/domain/5/data/multiline":         "a\nb",
+		"/local/domain/5/device/vbd/768/backend": "/local/domain/0/backend/vbd/5/768",
+	} {
+		if _, err := c.Write(path, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.SetPermissions("/local/domain/5/name", []string{"n5", "r0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := c.FS("/local/domain/5")
+
+	if err := fstest.TestFS(fsys,
+		"name",
+		"device/vif/0/state",
+		"device/vif/1/state",
+		"device/vbd/768/backend",
+		"control/shutdown",
+		"data/multiline",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fs.ReadFile(fsys, "device/vif/0/mac")
+	assert.Nil(t, err)
+	assert.Equal(t, "00:16:3e:00:00:01", string(b))
+
+	info, err := fs.Stat(fsys, "name")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"n5", "r0"}, info.Sys())
+		assert.Equal(t, int64(5), info.Size())
+	}
+
+	states, err := fs.Glob(fsys, "device/vif/*/state")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"device/vif/0/state", "device/vif/1/state"}, states)
+
+	_, err = fs.ReadFile(fsys, "missing")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestFSReadDirSkipsRemoved(t *testing.T) {
+	s := xenstoretest.NewScriptedTransport(t)
+	s.Expect(XsDirectory, "/d").Respond("a", "b")
+	s.Expect(XsDirectory, "/d/a").Respond("")
+	s.Expect(XsRead, "/d/a").Respond("value")
+	s.Expect(XsGetPermissions, "/d/a").Respond("n0")
+	// b is removed after the directory was listed
+	s.Expect(XsDirectory, "/d/b").RespondError(ErrNotFound)
+	s.Expect(XsRead, "/d/b").RespondError(ErrNotFound)
+	s.Expect(XsGetPermissions, "/d/b").RespondError(ErrNotFound)
+
+	c := NewClient(s)
+	defer c.Close()
+
+	entries, err := fs.ReadDir(c.FS("/d"), ".")
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "a", entries[0].Name())
+		assert.False(t, entries[0].IsDir())
+	}
+}
@@ -0,0 +1,370 @@
+package xenstore
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Glob returns the paths of all of the nodes matching pattern, in sorted order.
+// Each segment of pattern is matched against a single path element using the syntax
+// of path.Match, with two additions:
+//
+//   - "**" as a whole segment matches zero or more path elements.
+//   - "{a,b}" matches either of the comma separated alternatives, which may
+//     themselves contain patterns or "/".
+//
+// For example "/local/domain/*/device/{vif,vbd}/*/state" finds the state of every
+// network & block device of every domain. The pattern must be an absolute path.
+//
+// The tree is expanded using one List request for each node matched by a wildcard,
+// with all of the requests for a level of the tree sent before waiting for any of
+// the replies. Nodes which the connection is not allowed to list are skipped.
+func (c *Client) Glob(pattern string) ([]string, error) {
+	return c.glob(pattern, 0x0)
+}
+
+// Glob returns the paths of all of the nodes matching pattern within the
+// Transaction. See Client.Glob.
+func (t *Transaction) Glob(pattern string) ([]string, error) {
+	return t.client.glob(pattern, t.id)
+}
+
+func (c *Client) glob(pattern string, txid uint32) ([]string, error) {
+	if !strings.HasPrefix(pattern, XenStorePathSeparator) {
+		return nil, fmt.Errorf("%w: %q is not an absolute path", path.ErrBadPattern, pattern)
+	}
+
+	matches := map[string]bool{}
+
+	for _, expanded := range expandBraces(pattern) {
+		segments, err := splitGlob(expanded)
+		if err != nil {
+			return nil, err
+		}
+
+		found, err := c.globSegments(segments, txid)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range found {
+			matches[p] = true
+		}
+	}
+
+	paths := make([]string, 0, len(matches))
+	for p := range matches {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// splitGlob splits an absolute pattern without braces into its segments, checking
+// that each of them is well formed.
+func splitGlob(pattern string) ([]string, error) {
+	trimmed := strings.Trim(pattern, XenStorePathSeparator)
+	if trimmed == "" {
+		return nil, nil
+	}
+
+	segments := strings.Split(trimmed, XenStorePathSeparator)
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("%w: %q contains an empty path element", path.ErrBadPattern, pattern)
+		}
+
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("%w: %q", err, pattern)
+		}
+	}
+
+	return segments, nil
+}
+
+// globCandidate is a path which may match a pattern. Paths built from literal
+// segments are not known to exist until they have been listed.
+type globCandidate struct {
+	path   string
+	exists bool
+}
+
+func (c *Client) globSegments(segments []string, txid uint32) ([]string, error) {
+	candidates := []globCandidate{{path: XenStorePathSeparator, exists: true}}
+
+	for _, segment := range segments {
+		var next []globCandidate
+
+		switch {
+		case segment == "**":
+			// Every candidate which exists along with all of its descendants
+			frontier := candidates
+			for len(frontier) > 0 {
+				children, err := c.listCandidates(frontier, txid)
+				if err != nil {
+					return nil, err
+				}
+
+				var deeper []globCandidate
+				for i, candidate := range frontier {
+					if children[i] == nil {
+						continue
+					}
+
+					next = append(next, globCandidate{path: candidate.path, exists: true})
+					for _, child := range children[i] {
+						deeper = append(deeper, globCandidate{path: joinGlobPath(candidate.path, child)})
+					}
+				}
+				frontier = deeper
+			}
+
+		case !hasGlobMeta(segment):
+			for _, candidate := range candidates {
+				next = append(next, globCandidate{path: joinGlobPath(candidate.path, segment)})
+			}
+
+		default:
+			children, err := c.listCandidates(candidates, txid)
+			if err != nil {
+				return nil, err
+			}
+
+			for i, candidate := range candidates {
+				for _, child := range children[i] {
+					// The pattern has already been checked so this cannot fail
+					if ok, _ := path.Match(segment, child); ok {
+						next = append(next, globCandidate{path: joinGlobPath(candidate.path, child), exists: true})
+					}
+				}
+			}
+		}
+
+		candidates = next
+		if len(candidates) == 0 {
+			return nil, nil
+		}
+	}
+
+	// Check that the paths ending in literal segments actually exist
+	var unchecked []globCandidate
+	for _, candidate := range candidates {
+		if !candidate.exists {
+			unchecked = append(unchecked, candidate)
+		}
+	}
+
+	children, err := c.listCandidates(unchecked, txid)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	var i int
+	for _, candidate := range candidates {
+		if !candidate.exists {
+			exists := children[i] != nil
+			i++
+
+			if !exists {
+				continue
+			}
+		}
+
+		paths = append(paths, candidate.path)
+	}
+
+	return paths, nil
+}
+
+// listCandidates lists the children of all of candidates. See listAll.
+func (c *Client) listCandidates(candidates []globCandidate, txid uint32) ([][]string, error) {
+	paths := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		paths[i] = candidate.path
+	}
+
+	return c.listAll(paths, txid)
+}
+
+// listAll lists the children of all of paths, sending every request before waiting
+// for any of the replies. The entry for a node which does not exist, or which the
+// connection is not allowed to list, is nil.
+func (c *Client) listAll(paths []string, txid uint32) ([][]string, error) {
+	type request struct {
+		pkt *Packet
+		ch  chan *Packet
+	}
+
+	requests := make([]request, len(paths))
+	for i, path := range paths {
+		p, ch, err := c.sendBytes(XsDirectory, append([]byte(path), NUL), txid)
+		if err != nil {
+			return nil, err
+		}
+
+		requests[i] = request{p, ch}
+	}
+
+	children := make([][]string, len(paths))
+	var firstErr error
+
+	// Wait for every reply, even after an error, so none are left to time out
+	for i, req := range requests {
+		rsp, err := c.waitReply(req.pkt, req.ch)
+		switch {
+		case errors.Is(err, ErrNotFound), errors.Is(err, ErrPermission):
+			continue
+		case err != nil:
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		children[i] = []string{}
+		if payload := rsp.payloadString(); payload != "" {
+			children[i] = strings.Split(payload, "\x00")
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return children, nil
+}
+
+func joinGlobPath(parent, child string) string {
+	if parent == XenStorePathSeparator {
+		return parent + child
+	}
+
+	return parent + XenStorePathSeparator + child
+}
+
+// hasGlobMeta reports whether segment contains any of the special characters
+// recognised by path.Match.
+func hasGlobMeta(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
+
+// expandBraces expands every "{a,b}" group in pattern, returning one pattern for each
+// combination of alternatives. Groups may be nested. Unbalanced braces are left as
+// they are.
+func expandBraces(pattern string) []string {
+	depth := 0
+	start := -1
+
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				start = i
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				continue
+			}
+
+			depth--
+			if depth > 0 {
+				continue
+			}
+
+			var expanded []string
+			for _, alternative := range splitAlternatives(pattern[start+1 : i]) {
+				expanded = append(expanded, expandBraces(pattern[:start]+alternative+pattern[i+1:])...)
+			}
+			return expanded
+		}
+	}
+
+	return []string{pattern}
+}
+
+// splitAlternatives splits the contents of a brace group on the commas which are not
+// within a nested group.
+func splitAlternatives(group string) []string {
+	var alternatives []string
+	depth := 0
+	start := 0
+
+	for i := 0; i < len(group); i++ {
+		switch group[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				alternatives = append(alternatives, group[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(alternatives, group[start:])
+}
+
+// MatchGlob reports whether the path p matches pattern, using the same syntax as
+// Client.Glob but without accessing XenStore. Relative paths & special paths such as
+// "@introduceDomain" only match patterns of the same kind. An error is returned if
+// pattern is malformed. It allows paths which were not read from XenStore, such as
+// those in a capture, to be filtered in the same way as Client.Glob.
+func MatchGlob(pattern, p string) (bool, error) {
+	if strings.HasPrefix(pattern, XenStorePathSeparator) != strings.HasPrefix(p, XenStorePathSeparator) {
+		return false, nil
+	}
+
+	var parts []string
+	if trimmed := strings.Trim(p, XenStorePathSeparator); trimmed != "" {
+		parts = strings.Split(trimmed, XenStorePathSeparator)
+	}
+
+	for _, expanded := range expandBraces(pattern) {
+		segments, err := splitGlob(expanded)
+		if err != nil {
+			return false, err
+		}
+
+		if matchSegments(segments, parts) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// matchSegments reports whether the elements of a path match the segments of a
+// pattern which have already been checked by splitGlob.
+func matchSegments(segments, parts []string) bool {
+	if len(segments) == 0 {
+		return len(parts) == 0
+	}
+
+	if segments[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(segments[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(parts) == 0 {
+		return false
+	}
+
+	ok, _ := path.Match(segments[0], parts[0])
+	return ok && matchSegments(segments[1:], parts[1:])
+}
@@ -0,0 +1,120 @@
+package xenstore_test
+
+import (
+	"errors"
+	"path"
+	"testing"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientGlob(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	for p, value := range map[string]string{
+		"/local/domain/1/name":                 "one",
+		"/local/domain/1/device/vif/0/state":   "4",
+		"/local/domain/1/device/vif/1/state":   "6",
+		"/local/domain/1/device/vbd/768/state": "4",
+		"/local/domain/2/name":                 "two",
+		"/local/domain/2/device/vif/0/state":   "1",
+		"/local/domain/2/device/vif/0/mac":     "00:16:3e:00:00:01",
+	} {
+		if _, err := c.Write(p, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"/", []string{"/"}},
+		{"/local/domain/1/name", []string{"/local/domain/1/name"}},
+		{"/local/domain/3/name", []string{}},
+		{"/local/domain/*/name", []string{"/local/domain/1/name", "/local/domain/2/name"}},
+		{"/local/domain/?/device/vif/*/state", []string{
+			"/local/domain/1/device/vif/0/state",
+			"/local/domain/1/device/vif/1/state",
+			"/local/domain/2/device/vif/0/state",
+		}},
+		{"/local/domain/*/device/{vif,vbd}/*/state", []string{
+			"/local/domain/1/device/vbd/768/state",
+			"/local/domain/1/device/vif/0/state",
+			"/local/domain/1/device/vif/1/state",
+			"/local/domain/2/device/vif/0/state",
+		}},
+		{"/local/domain/{1/name,2/device/vif/0/{mac,missing}}", []string{
+			"/local/domain/1/name",
+			"/local/domain/2/device/vif/0/mac",
+		}},
+		{"/local/**/state", []string{
+			"/local/domain/1/device/vbd/768/state",
+			"/local/domain/1/device/vif/0/state",
+			"/local/domain/1/device/vif/1/state",
+			"/local/domain/2/device/vif/0/state",
+		}},
+		{"/local/domain/2/**", []string{
+			"/local/domain/2",
+			"/local/domain/2/device",
+			"/local/domain/2/device/vif",
+			"/local/domain/2/device/vif/0",
+			"/local/domain/2/device/vif/0/mac",
+			"/local/domain/2/device/vif/0/state",
+			"/local/domain/2/name",
+		}},
+		{"/local/domain/[2-9]/device/vif/0/ma?", []string{"/local/domain/2/device/vif/0/mac"}},
+	} {
+		t.Run(tc.pattern, func(t *testing.T) {
+			paths, err := c.Glob(tc.pattern)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.want, paths)
+			}
+		})
+	}
+}
+
+func TestClientGlobBadPattern(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	for _, pattern := range []string{"local/domain/*", "/local/[", "/local//domain"} {
+		_, err := c.Glob(pattern)
+		assert.True(t, errors.Is(err, path.ErrBadPattern), "%s: %v", pattern, err)
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	assert.Equal(t, []string{"/a"}, ExpandBraces("/a"))
+	assert.Equal(t, []string{"/a/x", "/a/y"}, ExpandBraces("/a/{x,y}"))
+	assert.Equal(t, []string{"/x1", "/x2", "/y"}, ExpandBraces("/{x{1,2},y}"))
+	assert.Equal(t, []string{"/a-c", "/a-d", "/b-c", "/b-d"}, ExpandBraces("/{a,b}-{c,d}"))
+	assert.Equal(t, []string{"/{a"}, ExpandBraces("/{a"))
+	assert.Equal(t, []string{`/\{a,b}`}, ExpandBraces(`/\{a,b}`))
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/local/domain/*/name", "/local/domain/1/name", true},
+		{"/local/domain/*/name", "/local/domain/1/other", false},
+		{"/local/domain/*/name", "/local/domain/name", false},
+		{"/vm/**", "/vm", true},
+		{"/vm/**", "/vm/1/name", true},
+		{"/vm/**", "/vmx", false},
+		{"/local/domain/1/{name,data/**}", "/local/domain/1/data/a/b", true},
+		{"/**", "/", true},
+		{"/local/domain/1/name", "name", false},
+		{"name", "name", true},
+		{"@introduceDomain", "@introduceDomain", true},
+	} {
+		got, err := MatchGlob(tc.pattern, tc.path)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, got, "MatchGlob(%q, %q)", tc.pattern, tc.path)
+	}
+}
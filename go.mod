@@ -6,17 +6,19 @@ toolchain go1.26.1
 
 require (
 	github.com/go-ole/go-ole v1.3.0
+	github.com/hanwen/go-fuse/v2 v2.8.0
 	github.com/joelnb/wmi v0.0.0-20220227211458-fee931480b9c
 	github.com/lunixbochs/struc v0.0.0-20241101090106-8d528fa2c543
 	github.com/onrik/logrus v0.11.0
 	github.com/sirupsen/logrus v1.9.4
 	github.com/stretchr/testify v1.11.1
 	github.com/urfave/cli/v3 v3.9.1
+	golang.org/x/term v0.27.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -56,6 +56,13 @@ func UnixSocketPath() string {
 	return path.Join(rundir, "socket")
 }
 
+// ReadOnlyUnixSocketPath gets the path to the read-only XenStore unix socket on this
+// system, which is UnixSocketPath with "_ro" appended. Only some versions of xenstored
+// provide it. Requests which modify XenStore fail with ErrReadOnly when using it.
+func ReadOnlyUnixSocketPath() string {
+	return UnixSocketPath() + "_ro"
+}
+
 // XenBusPath returns the path to the XenBus device on this system
 func XenBusPath() string {
 	switch runtime.GOOS {
@@ -72,6 +72,17 @@ func TestUnixSocketPath(t *testing.T) {
 		"Should have a default if neither env variable is set")
 }
 
+func TestReadOnlyUnixSocketPath(t *testing.T) {
+	setEnvOrPanic("XENSTORED_PATH", "/example/xensocket")
+	setEnvOrPanic("XENSTORED_RUNDIR", "")
+	assert.Equal(t, "/example/xensocket_ro", ReadOnlyUnixSocketPath(),
+		"Should be based on XENSTORED_PATH if XENSTORED_PATH is set")
+
+	setEnvOrPanic("XENSTORED_PATH", "")
+	assert.Equal(t, "/var/run/xenstored/socket_ro", ReadOnlyUnixSocketPath(),
+		"Should have a default if neither env variable is set")
+}
+
 func TestPathJoin(t *testing.T) {
 	assert.Equal(t, "/tools/vm", JoinXenStorePath("/tools", "vm"),
 		"Should preserve leading slash when joining")
@@ -0,0 +1,459 @@
+package xenstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrLockNotHeld is returned by Lock.Unlock when the Lock is not held by its owner,
+// either because it was never locked or because it was lost.
+var ErrLockNotHeld = errors.New("lock not held")
+
+// DefaultLockLease is the lease used by a Lock unless WithLockLease is given.
+const DefaultLockLease = 15 * time.Second
+
+// The keys stored below the path of a Lock while it is held.
+const (
+	lockOwnerKey   = "owner"
+	lockExpiresKey = "expires"
+)
+
+// LockOption configures optional behaviour of a Lock created by NewLock.
+type LockOption func(*lockOptions)
+
+type lockOptions struct {
+	owner string
+	lease time.Duration
+}
+
+// WithLockOwner sets the identifier written to XenStore while the Lock is held. It
+// must be unique among the clients sharing the Lock. The default is made up of the
+// host name, process ID & a counter.
+func WithLockOwner(owner string) LockOption {
+	return func(o *lockOptions) {
+		o.owner = owner
+	}
+}
+
+// WithLockLease sets how long the Lock stays held if its owner stops renewing it, for
+// example because the process died. The lease is renewed in the background while the
+// Lock is held. Zero means the Lock never expires. The default is DefaultLockLease.
+func WithLockLease(d time.Duration) LockOption {
+	return func(o *lockOptions) {
+		o.lease = d
+	}
+}
+
+// Lock is a mutual exclusion lock shared between cooperating clients of XenStore,
+// such as redundant daemons in dom0. While the Lock is held the owner is stored in
+// the "owner" key below its path & the time the lease runs out in the "expires" key,
+// as an RFC 3339 timestamp. All of the clients must agree on the time, so the Lock is
+// only suitable for clients running on the same host.
+//
+// A Lock may be locked & unlocked repeatedly, but not from several goroutines at once.
+type Lock struct {
+	client *Client
+	path   string
+	opts   lockOptions
+
+	lock    sync.Mutex
+	held    bool
+	lost    chan struct{}
+	stop    chan struct{}
+	renewed sync.WaitGroup
+}
+
+// NewLock returns a Lock which is stored below path, for example
+// "/tool/myapp/lock". The Lock is not acquired until Lock or TryLock is called.
+func NewLock(c *Client, path string, opts ...LockOption) *Lock {
+	o := lockOptions{lease: DefaultLockLease}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.owner == "" {
+		hostname, _ := os.Hostname()
+		o.owner = fmt.Sprintf("%s/%d/%d", hostname, os.Getpid(), watchTokenCounter.Add(1))
+	}
+
+	lost := make(chan struct{})
+	close(lost)
+
+	return &Lock{
+		client: c,
+		path:   path,
+		opts:   o,
+		lost:   lost,
+	}
+}
+
+// Owner returns the identifier this Lock writes to XenStore while it is held.
+func (l *Lock) Owner() string {
+	return l.opts.owner
+}
+
+// Holder returns the owner currently holding the Lock, which may be a different
+// Lock, or an empty string if nobody holds it.
+func (l *Lock) Holder() (string, error) {
+	var holder string
+
+	err := l.client.Transact(func(tx *Transaction) error {
+		owner, expires, err := l.read(tx)
+		if err != nil {
+			return err
+		}
+
+		holder = ""
+		if owner != "" && (expires.IsZero() || time.Now().Before(expires)) {
+			holder = owner
+		}
+
+		return nil
+	})
+
+	return holder, err
+}
+
+// Lock acquires the Lock, waiting until it is released or its lease runs out if it is
+// held by somebody else. If ctx is done first then its error is returned.
+func (l *Lock) Lock(ctx context.Context) error {
+	w, err := l.client.watchChanges(l.path)
+	if err != nil {
+		return err
+	}
+
+	err = l.lockWatching(ctx, w)
+
+	if closeErr := w.close(); closeErr != nil && err == nil {
+		// The Lock is held but there is no sensible way to report that alongside the
+		// error, so release it again
+		l.Unlock()
+		return closeErr
+	}
+
+	return err
+}
+
+func (l *Lock) lockWatching(ctx context.Context, w *changeWatch) error {
+	for {
+		expires, acquired, err := l.tryLock()
+		if err != nil || acquired {
+			return err
+		}
+
+		if err := l.waitForRelease(ctx, w, expires); err != nil {
+			return err
+		}
+	}
+}
+
+// waitForRelease waits for the Lock to change or for the lease of the holder, which
+// runs out at expires, to run out.
+func (l *Lock) waitForRelease(ctx context.Context, w *changeWatch, expires time.Time) error {
+	var timeout <-chan time.Time
+	if !expires.IsZero() {
+		timer := time.NewTimer(time.Until(expires))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.changed:
+	case <-timeout:
+	case <-w.failed:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// TryLock acquires the Lock if nobody else holds it, reporting whether it did.
+func (l *Lock) TryLock() (bool, error) {
+	_, acquired, err := l.tryLock()
+	return acquired, err
+}
+
+// tryLock acquires the Lock if possible. If it is held by somebody else the time
+// their lease runs out is returned, or the zero time if it never does.
+func (l *Lock) tryLock() (time.Time, bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.held {
+		return time.Time{}, false, fmt.Errorf("%s: already locked by %s", l.path, l.opts.owner)
+	}
+
+	var expires time.Time
+	var acquired bool
+
+	err := l.client.Transact(func(tx *Transaction) error {
+		owner, current, err := l.read(tx)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if owner != "" && owner != l.opts.owner && (current.IsZero() || now.Before(current)) {
+			expires, acquired = current, false
+			return nil
+		}
+
+		acquired = true
+		return l.write(tx, now)
+	})
+	if err != nil || !acquired {
+		return expires, false, err
+	}
+
+	l.held = true
+	l.lost = make(chan struct{})
+	l.stop = make(chan struct{})
+
+	if l.opts.lease > 0 {
+		l.renewed.Add(1)
+		go l.renew(l.stop)
+	}
+
+	return time.Time{}, true, nil
+}
+
+// Lost returns a channel which is closed when the Lock stops being held, either
+// because Unlock was called or because the lease could not be renewed before it ran
+// out, in which case somebody else may now hold the Lock. The channel is already
+// closed if the Lock is not held.
+func (l *Lock) Lost() <-chan struct{} {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.lost
+}
+
+// Unlock releases the Lock. ErrLockNotHeld is returned if the Lock was not held, or
+// has been lost since it was acquired.
+func (l *Lock) Unlock() error {
+	l.lock.Lock()
+	if !l.held {
+		l.lock.Unlock()
+		return &OpError{Op: "unlock", Path: l.path, Err: ErrLockNotHeld}
+	}
+
+	l.held = false
+	close(l.stop)
+	l.lock.Unlock()
+
+	l.renewed.Wait()
+
+	err := l.client.Transact(func(tx *Transaction) error {
+		owner, _, err := l.read(tx)
+		if err != nil {
+			return err
+		}
+
+		if owner != l.opts.owner {
+			return &OpError{Op: "unlock", Path: l.path, TxID: tx.id, Err: ErrLockNotHeld}
+		}
+
+		_, err = tx.Remove(l.path)
+		return err
+	})
+
+	l.markLost()
+	return err
+}
+
+// markLost closes the channel returned by Lost if it is still open.
+func (l *Lock) markLost() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	select {
+	case <-l.lost:
+	default:
+		close(l.lost)
+	}
+	l.held = false
+}
+
+// renew extends the lease every third of its length until stop is closed, marking the
+// Lock as lost if it is taken over or cannot be renewed before the lease runs out.
+func (l *Lock) renew(stop chan struct{}) {
+	defer l.renewed.Done()
+
+	ticker := time.NewTicker(l.opts.lease / 3)
+	defer ticker.Stop()
+
+	expires := time.Now().Add(l.opts.lease)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		now := time.Now()
+		err := l.client.Transact(func(tx *Transaction) error {
+			owner, _, err := l.read(tx)
+			if err != nil {
+				return err
+			}
+
+			if owner != l.opts.owner {
+				return &OpError{Op: "renew", Path: l.path, TxID: tx.id, Err: ErrLockNotHeld}
+			}
+
+			return l.write(tx, now)
+		})
+
+		switch {
+		case err == nil:
+			expires = now.Add(l.opts.lease)
+			continue
+		case !errors.Is(err, ErrLockNotHeld) && time.Now().Before(expires):
+			// Try again on the next tick while the lease is still valid
+			continue
+		}
+
+		l.markLost()
+		return
+	}
+}
+
+// read returns the current owner of the Lock & when their lease runs out. The owner is
+// empty if the Lock is not held.
+func (l *Lock) read(tx *Transaction) (string, time.Time, error) {
+	values, errs := tx.ReadMany([]string{
+		JoinXenStorePath(l.path, lockOwnerKey),
+		JoinXenStorePath(l.path, lockExpiresKey),
+	})
+
+	owner := values[JoinXenStorePath(l.path, lockOwnerKey)]
+	if err := errs[JoinXenStorePath(l.path, lockOwnerKey)]; err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return "", time.Time{}, nil
+		}
+		return "", time.Time{}, err
+	}
+
+	var expires time.Time
+	if value, ok := values[JoinXenStorePath(l.path, lockExpiresKey)]; ok {
+		var err error
+		if expires, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			// Treat a corrupt lease as having run out rather than leaving the Lock
+			// held forever
+			expires = time.Unix(0, 0)
+		}
+	} else if err := errs[JoinXenStorePath(l.path, lockExpiresKey)]; !errors.Is(err, ErrNotFound) {
+		return "", time.Time{}, err
+	}
+
+	return owner, expires, nil
+}
+
+// write records this Lock as the owner with a lease starting at now.
+func (l *Lock) write(tx *Transaction, now time.Time) error {
+	if _, err := tx.Write(JoinXenStorePath(l.path, lockOwnerKey), l.opts.owner); err != nil {
+		return err
+	}
+
+	expiresPath := JoinXenStorePath(l.path, lockExpiresKey)
+	if l.opts.lease <= 0 {
+		_, err := tx.Remove(expiresPath)
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+		return err
+	}
+
+	_, err := tx.Write(expiresPath, now.Add(l.opts.lease).UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+// changeWatch signals on changed whenever anything at or below a path changes,
+// draining the watch from its own goroutine so that the Router is never blocked while
+// the caller sends other requests.
+type changeWatch struct {
+	client *Client
+	path   string
+	token  string
+
+	changed chan struct{}
+	failed  chan struct{}
+	err     error
+	closed  chan struct{}
+	done    chan struct{}
+}
+
+// watchChanges sets up a changeWatch on path. XenStore fires every new watch once
+// straight away so changed is signalled immediately.
+func (c *Client) watchChanges(path string) (*changeWatch, error) {
+	w := &changeWatch{
+		client:  c,
+		path:    path,
+		token:   c.newWatchToken(),
+		changed: make(chan struct{}, 1),
+		failed:  make(chan struct{}),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	ch, err := c.Watch(path, w.token)
+	if err != nil {
+		return nil, err
+	}
+
+	go w.receive(ch)
+
+	return w, nil
+}
+
+func (w *changeWatch) receive(ch chan *Packet) {
+	defer close(w.done)
+
+	for {
+		select {
+		case rsp, ok := <-ch:
+			switch {
+			case w.err != nil:
+				// Keep draining until the watch is removed
+			case !ok:
+				w.err = ErrConnectionLost
+				close(w.failed)
+			case rsp.Header.Op == XsError:
+				w.err = &OpError{Op: XsWatch.String(), Path: w.path, Err: rsp.Check()}
+				close(w.failed)
+			case rsp.Header.Op == XsWatchEvent:
+				select {
+				case w.changed <- struct{}{}:
+				default:
+				}
+			}
+
+			if !ok {
+				return
+			}
+
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// close removes the watch & waits for the receiving goroutine to exit.
+func (w *changeWatch) close() error {
+	err := w.client.UnWatch(w.path, w.token)
+	if errors.Is(err, ErrRouterStopped) {
+		err = nil
+	}
+
+	close(w.closed)
+	<-w.done
+
+	return err
+}
@@ -0,0 +1,215 @@
+package xenstore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	c1, c2 := store.Client(), store.Client()
+	defer c1.Close()
+	defer c2.Close()
+
+	l1 := NewLock(c1, "/tool/test/lock", WithLockOwner("one"))
+	l2 := NewLock(c2, "/tool/test/lock", WithLockOwner("two"))
+
+	assert.NoError(t, l1.Lock(context.Background()))
+
+	owner, err := c1.Read("/tool/test/lock/owner")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", owner)
+
+	holder, err := l2.Holder()
+	assert.NoError(t, err)
+	assert.Equal(t, "one", holder)
+
+	ok, err := l2.TryLock()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.Is(l2.Lock(ctx), context.DeadlineExceeded))
+
+	// Unlocking wakes up the waiter
+	locked := make(chan error, 1)
+	go func() {
+		locked <- l2.Lock(context.Background())
+	}()
+
+	// Wait for the waiter to watch the Lock, so that it is woken by the change
+	waitUntil(t, func() bool { return c2.WatchCount() == 1 })
+	assert.NoError(t, l1.Unlock())
+
+	select {
+	case err := <-locked:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not acquired")
+	}
+
+	holder, err = l1.Holder()
+	assert.NoError(t, err)
+	assert.Equal(t, "two", holder)
+
+	assert.NoError(t, l2.Unlock())
+	assert.True(t, errors.Is(l2.Unlock(), ErrLockNotHeld))
+
+	_, err = c1.Read("/tool/test/lock")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Zero(t, c1.WatchCount())
+	assert.Zero(t, c2.WatchCount())
+}
+
+func TestLockExpired(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	// Left behind by an owner which died without unlocking
+	if _, err := c.Write("/tool/test/lock/owner", "dead"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write("/tool/test/lock/expires", time.Now().Add(100*time.Millisecond).Format(time.RFC3339Nano)); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewLock(c, "/tool/test/lock", WithLockOwner("alive"))
+
+	ok, err := l.TryLock()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Nothing changes in XenStore, so this relies on waiting for the lease to run out
+	assert.NoError(t, l.Lock(ctx))
+	assert.NoError(t, l.Unlock())
+}
+
+func TestLockLost(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	c, other := store.Client(), store.Client()
+	defer c.Close()
+	defer other.Close()
+
+	l := NewLock(c, "/tool/test/lock", WithLockOwner("one"), WithLockLease(90*time.Millisecond))
+	assert.NoError(t, l.Lock(context.Background()))
+
+	select {
+	case <-l.Lost():
+		t.Fatal("lock lost straight away")
+	default:
+	}
+
+	expires, err := other.Read("/tool/test/lock/expires")
+	assert.NoError(t, err)
+
+	// The lease is renewed while the lock is held
+	waitUntil(t, func() bool {
+		renewed, err := other.Read("/tool/test/lock/expires")
+		return err == nil && renewed != expires
+	})
+
+	owner, err := other.Read("/tool/test/lock/owner")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", owner)
+
+	if _, err := other.Write("/tool/test/lock/owner", "thief"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-l.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not lost")
+	}
+
+	assert.True(t, errors.Is(l.Unlock(), ErrLockNotHeld))
+}
+
+func TestElection(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	c1, c2 := store.Client(), store.Client()
+	defer c1.Close()
+	defer c2.Close()
+
+	e1 := NewElection(c1, "/tool/test/leader", WithLockOwner("one"))
+	e2 := NewElection(c2, "/tool/test/leader", WithLockOwner("two"))
+
+	changes1 := make(chan bool, 4)
+	changes2 := make(chan bool, 4)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+
+	done1 := make(chan error, 1)
+	go func() {
+		done1 <- e1.Run(ctx1, func(leader bool) { changes1 <- leader })
+	}()
+
+	assert.True(t, nextLeaderChange(t, changes1))
+	assert.True(t, e1.IsLeader())
+
+	done2 := make(chan error, 1)
+	go func() {
+		done2 <- e2.Run(ctx2, func(leader bool) { changes2 <- leader })
+	}()
+
+	leader, err := e2.Leader()
+	assert.NoError(t, err)
+	assert.Equal(t, "one", leader)
+	assert.False(t, e2.IsLeader())
+
+	// Stopping the leader hands over to the other candidate
+	cancel1()
+	assert.False(t, nextLeaderChange(t, changes1))
+	assert.True(t, errors.Is(<-done1, context.Canceled))
+
+	assert.True(t, nextLeaderChange(t, changes2))
+
+	leader, err = e1.Leader()
+	assert.NoError(t, err)
+	assert.Equal(t, "two", leader)
+
+	cancel2()
+	assert.False(t, nextLeaderChange(t, changes2))
+	assert.True(t, errors.Is(<-done2, context.Canceled))
+}
+
+// nextLeaderChange waits for the next change reported by Election.Run.
+func nextLeaderChange(t *testing.T, changes chan bool) bool {
+	t.Helper()
+
+	select {
+	case leader := <-changes:
+		return leader
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a leadership change")
+		return false
+	}
+}
+
+// waitUntil polls condition until it is true, failing the test if that takes too long.
+func waitUntil(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
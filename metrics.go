@@ -0,0 +1,260 @@
+package xenstore
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds (in seconds) of the buckets used by
+// Metrics to record request latency.
+var DefaultLatencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+// Observer is notified by a Router about the packets passing through it. Methods are
+// called synchronously from the Router so implementations should return quickly and
+// must be safe for concurrent use.
+type Observer interface {
+	// RequestSent is called just before a request Packet is written to the Transport,
+	// so that it is always called before ResponseReceived for the same request.
+	RequestSent(req *Packet)
+	// ResponseReceived is called when the reply to a request is received along with
+	// the time elapsed since the request was sent. rsp is nil if the request was
+	// abandoned because it could not be written or the connection to XenStore was
+	// lost.
+	ResponseReceived(req, rsp *Packet, latency time.Duration)
+	// WatchEvent is called for every watch event received from XenStore.
+	WatchEvent(event *Packet)
+}
+
+// Metrics is an Observer which keeps counters of the requests made to XenStore, the
+// errors returned, the number of requests in flight, the watch events received and
+// the latency of each type of request.
+type Metrics struct {
+	inFlight    int64
+	watchEvents uint64
+
+	lock     sync.Mutex
+	buckets  []float64
+	requests map[Operation]uint64
+	errors   map[errorKey]uint64
+	latency  map[Operation]*latencyHistogram
+}
+
+type errorKey struct {
+	op    Operation
+	errno string
+}
+
+type latencyHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// MetricsSnapshot is a point-in-time copy of the values held by Metrics. Maps are
+// keyed by operation name (see the String method of the operation constants).
+type MetricsSnapshot struct {
+	// Requests is the number of requests sent for each operation.
+	Requests map[string]uint64
+	// Errors is the number of error replies for each operation, keyed by errno name.
+	Errors map[string]map[string]uint64
+	// InFlight is the number of requests which have been sent but not yet answered.
+	InFlight int64
+	// WatchEvents is the total number of watch events received.
+	WatchEvents uint64
+	// Latency is the distribution of request latency for each operation.
+	Latency map[string]LatencySnapshot
+}
+
+// LatencySnapshot describes the distribution of request latency for a single operation.
+type LatencySnapshot struct {
+	// Buckets holds the upper bound of each bucket in seconds.
+	Buckets []float64
+	// Counts holds the cumulative number of requests which fell into each bucket.
+	Counts []uint64
+	// Count is the total number of requests observed.
+	Count uint64
+	// Sum is the total latency of all requests observed in seconds.
+	Sum float64
+}
+
+// NewMetrics creates a new Metrics instance using DefaultLatencyBuckets.
+func NewMetrics() *Metrics {
+	return NewMetricsWithBuckets(DefaultLatencyBuckets)
+}
+
+// NewMetricsWithBuckets creates a new Metrics instance which records latency using
+// the provided bucket upper bounds (in seconds).
+func NewMetricsWithBuckets(buckets []float64) *Metrics {
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+
+	return &Metrics{
+		buckets:  b,
+		requests: map[Operation]uint64{},
+		errors:   map[errorKey]uint64{},
+		latency:  map[Operation]*latencyHistogram{},
+	}
+}
+
+// RequestSent implements Observer.
+func (m *Metrics) RequestSent(req *Packet) {
+	atomic.AddInt64(&m.inFlight, 1)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.requests[req.Header.Op]++
+}
+
+// ResponseReceived implements Observer.
+func (m *Metrics) ResponseReceived(req, rsp *Packet, latency time.Duration) {
+	atomic.AddInt64(&m.inFlight, -1)
+
+	if rsp == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if rsp.Header.Op == XsError {
+		errno := rsp.payloadString()
+		if _, ok := xenStoreErrors[errno]; !ok {
+			errno = "UNKNOWN"
+		}
+
+		m.errors[errorKey{req.Header.Op, errno}]++
+	}
+
+	h, ok := m.latency[req.Header.Op]
+	if !ok {
+		h = &latencyHistogram{counts: make([]uint64, len(m.buckets))}
+		m.latency[req.Header.Op] = h
+	}
+
+	seconds := latency.Seconds()
+	for i, upper := range m.buckets {
+		if seconds <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// WatchEvent implements Observer.
+func (m *Metrics) WatchEvent(event *Packet) {
+	atomic.AddUint64(&m.watchEvents, 1)
+}
+
+// Snapshot returns a copy of the current values of all metrics.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s := MetricsSnapshot{
+		Requests:    map[string]uint64{},
+		Errors:      map[string]map[string]uint64{},
+		InFlight:    atomic.LoadInt64(&m.inFlight),
+		WatchEvents: atomic.LoadUint64(&m.watchEvents),
+		Latency:     map[string]LatencySnapshot{},
+	}
+
+	for op, n := range m.requests {
+		s.Requests[op.String()] = n
+	}
+
+	for key, n := range m.errors {
+		if _, ok := s.Errors[key.op.String()]; !ok {
+			s.Errors[key.op.String()] = map[string]uint64{}
+		}
+		s.Errors[key.op.String()][key.errno] = n
+	}
+
+	for op, h := range m.latency {
+		s.Latency[op.String()] = LatencySnapshot{
+			Buckets: append([]float64{}, m.buckets...),
+			Counts:  append([]uint64{}, h.counts...),
+			Count:   h.count,
+			Sum:     h.sum,
+		}
+	}
+
+	return s
+}
+
+// WritePrometheus writes the current values of all metrics to w using the Prometheus
+// text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	s := m.Snapshot()
+
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+
+	printf("# HELP xenstore_requests_total Total number of requests sent to XenStore.\n")
+	printf("# TYPE xenstore_requests_total counter\n")
+	for _, op := range sortedKeys(s.Requests) {
+		printf("xenstore_requests_total{op=%q} %d\n", op, s.Requests[op])
+	}
+
+	printf("# HELP xenstore_errors_total Total number of error replies received from XenStore.\n")
+	printf("# TYPE xenstore_errors_total counter\n")
+	for _, op := range sortedKeys(s.Errors) {
+		for _, errno := range sortedKeys(s.Errors[op]) {
+			printf("xenstore_errors_total{op=%q,errno=%q} %d\n", op, errno, s.Errors[op][errno])
+		}
+	}
+
+	printf("# HELP xenstore_requests_in_flight Number of requests awaiting a reply from XenStore.\n")
+	printf("# TYPE xenstore_requests_in_flight gauge\n")
+	printf("xenstore_requests_in_flight %d\n", s.InFlight)
+
+	printf("# HELP xenstore_watch_events_total Total number of watch events received from XenStore.\n")
+	printf("# TYPE xenstore_watch_events_total counter\n")
+	printf("xenstore_watch_events_total %d\n", s.WatchEvents)
+
+	printf("# HELP xenstore_request_duration_seconds Latency of requests sent to XenStore.\n")
+	printf("# TYPE xenstore_request_duration_seconds histogram\n")
+	for _, op := range sortedKeys(s.Latency) {
+		l := s.Latency[op]
+		for i, upper := range l.Buckets {
+			printf("xenstore_request_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, upper, l.Counts[i])
+		}
+		printf("xenstore_request_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, l.Count)
+		printf("xenstore_request_duration_seconds_sum{op=%q} %g\n", op, l.Sum)
+		printf("xenstore_request_duration_seconds_count{op=%q} %d\n", op, l.Count)
+	}
+
+	return err
+}
+
+// ServeHTTP implements http.Handler so that Metrics can be exposed directly to a
+// Prometheus server.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if err := m.WritePrometheus(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
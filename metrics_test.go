@@ -0,0 +1,183 @@
+package xenstore_test
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsObserveRouter(t *testing.T) {
+	m := NewMetrics()
+
+	tr := NewBufferTransport()
+	r := NewRouter(tr)
+	r.SetObserver(m)
+
+	p, err := NewPacket(XsRead, []byte("/local/domain/0/name\x00"), 0x0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := r.Send(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(1), m.Snapshot().InFlight)
+
+	// BufferTransport echoes the request back so it is delivered as the reply
+	go func() {
+		rsp, err := tr.Receive()
+		if err != nil {
+			panic(err)
+		}
+		r.DeliverPacket(rsp)
+	}()
+	<-ch
+
+	s := m.Snapshot()
+	assert.Equal(t, int64(0), s.InFlight)
+	assert.Equal(t, uint64(1), s.Requests["read"])
+	assert.Equal(t, uint64(1), s.Latency["read"].Count)
+}
+
+func TestMetricsErrorsAndEvents(t *testing.T) {
+	m := NewMetricsWithBuckets([]float64{0.1, 0.01})
+
+	req := &Packet{Header: &PacketHeader{Op: XsRead}}
+	m.RequestSent(req)
+	m.ResponseReceived(req, &Packet{Header: &PacketHeader{Op: XsError}, Payload: []byte("ENOENT\x00")}, 50*time.Millisecond)
+	m.RequestSent(req)
+	m.ResponseReceived(req, &Packet{Header: &PacketHeader{Op: XsError}, Payload: []byte("something odd\x00")}, 5*time.Millisecond)
+	m.WatchEvent(&Packet{Header: &PacketHeader{Op: XsWatchEvent}})
+
+	s := m.Snapshot()
+	assert.Equal(t, uint64(2), s.Requests["read"])
+	assert.Equal(t, uint64(1), s.Errors["read"]["ENOENT"])
+	assert.Equal(t, uint64(1), s.Errors["read"]["UNKNOWN"])
+	assert.Equal(t, uint64(1), s.WatchEvents)
+	assert.Equal(t, []float64{0.01, 0.1}, s.Latency["read"].Buckets)
+	assert.Equal(t, []uint64{1, 2}, s.Latency["read"].Counts)
+
+	buf := &bytes.Buffer{}
+	if err := m.WritePrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, line := range []string{
+		`xenstore_requests_total{op="read"} 2`,
+		`xenstore_errors_total{op="read",errno="ENOENT"} 1`,
+		`xenstore_requests_in_flight 0`,
+		`xenstore_watch_events_total 1`,
+		`xenstore_request_duration_seconds_bucket{op="read",le="0.01"} 1`,
+		`xenstore_request_duration_seconds_bucket{op="read",le="+Inf"} 2`,
+		`xenstore_request_duration_seconds_count{op="read"} 2`,
+	} {
+		assert.True(t, strings.Contains(out, line+"\n"), "missing line %q in:\n%s", line, out)
+	}
+}
+
+// orderObserver checks that RequestSent is always called before ResponseReceived.
+type orderObserver struct {
+	t *testing.T
+
+	lock sync.Mutex
+	sent map[uint32]bool
+}
+
+func (o *orderObserver) RequestSent(req *Packet) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.sent[req.Header.RqId] = true
+}
+
+func (o *orderObserver) ResponseReceived(req, rsp *Packet, latency time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if !o.sent[req.Header.RqId] {
+		o.t.Errorf("reply to request %d observed before the request", req.Header.RqId)
+	}
+	delete(o.sent, req.Header.RqId)
+}
+
+func (o *orderObserver) WatchEvent(event *Packet) {}
+
+func TestObserverOrder(t *testing.T) {
+	m := NewMetrics()
+	o := &orderObserver{t: t, sent: map[uint32]bool{}}
+
+	store := xenstoretest.NewMemoryStore()
+	c := NewClient(store.Connect(), WithObserver(observers{o, m}))
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				if _, err := c.Write("/test", "value"); err != nil {
+					t.Error(err)
+					return
+				}
+
+				assert.True(t, m.Snapshot().InFlight >= 0)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(0), m.Snapshot().InFlight)
+	assert.Empty(t, o.sent)
+}
+
+func TestMetricsWriteFailure(t *testing.T) {
+	m := NewMetrics()
+
+	tr := NewBufferTransport()
+	r := NewRouter(tr)
+	r.SetObserver(m)
+
+	tr.Close()
+
+	p, err := NewPacket(XsRead, []byte("/local/domain/0/name\x00"), 0x0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.Send(p)
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), m.Snapshot().InFlight)
+	assert.Equal(t, uint64(1), m.Snapshot().Requests["read"])
+}
+
+// observers notifies several Observers.
+type observers []Observer
+
+func (obs observers) RequestSent(req *Packet) {
+	for _, o := range obs {
+		o.RequestSent(req)
+	}
+}
+
+func (obs observers) ResponseReceived(req, rsp *Packet, latency time.Duration) {
+	for _, o := range obs {
+		o.ResponseReceived(req, rsp, latency)
+	}
+}
+
+func (obs observers) WatchEvent(event *Packet) {
+	for _, o := range obs {
+		o.WatchEvent(event)
+	}
+}
@@ -0,0 +1,428 @@
+package xenstore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MirrorChange describes a change to a single path in a Mirror.
+type MirrorChange struct {
+	Path string
+	// OldValue & Existed describe the path before the change.
+	OldValue string
+	Existed  bool
+	// NewValue & Exists describe the path after the change.
+	NewValue string
+	Exists   bool
+}
+
+// Mirror is an in-memory copy of a XenStore subtree which is kept up to date using a
+// watch, so that it can be read frequently without sending any requests to XenStore.
+// Reads are lock-free and see a consistent snapshot of the subtree.
+//
+// Nodes which the connection is not allowed to read are left out of the Mirror.
+type Mirror struct {
+	client   *Client
+	root     string
+	token    string
+	onChange func(MirrorChange)
+
+	values atomic.Pointer[map[string]string]
+
+	// pending holds the paths which have changed since they were last read.
+	lock    sync.Mutex
+	pending map[string]bool
+	initial bool
+	wake    chan struct{}
+
+	// stop is closed when the Mirror stops being updated, but the watch keeps being
+	// drained until closed is closed by Close.
+	stop      chan struct{}
+	stopOnce  sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+	workers   sync.WaitGroup
+}
+
+// NewMirror loads the subtree below root, using a transaction so that the initial
+// copy is consistent, and then keeps it up to date until Close is called. onChange,
+// if not nil, is called for every path which is added, removed or has its value
+// changed after the initial load. It is called from a single goroutine, in the order
+// the changes are seen, after the change is visible through the Mirror. onChange must
+// not call Close, which waits for that goroutine to exit, but it can signal another
+// goroutine to do so.
+func NewMirror(c *Client, root string, onChange func(MirrorChange)) (*Mirror, error) {
+	m := &Mirror{
+		client:   c,
+		root:     root,
+		token:    c.newWatchToken(),
+		onChange: onChange,
+		pending:  map[string]bool{},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	m.values.Store(&map[string]string{})
+
+	// Watch before loading so that no change can be missed
+	ch, err := c.Watch(root, m.token)
+	if err != nil {
+		return nil, err
+	}
+
+	m.workers.Add(1)
+	go m.receive(ch)
+
+	values := map[string]string{}
+	err = c.Transact(func(tx *Transaction) error {
+		values = map[string]string{}
+		return c.loadTree(root, tx.id, values)
+	})
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	m.values.Store(&values)
+
+	m.workers.Add(1)
+	go m.update()
+
+	return m, nil
+}
+
+// Read returns the value of path & whether it exists in the Mirror.
+func (m *Mirror) Read(path string) (string, bool) {
+	value, ok := (*m.values.Load())[path]
+	return value, ok
+}
+
+// List returns the names of the children of path in the Mirror, in sorted order.
+func (m *Mirror) List(path string) []string {
+	prefix := strings.TrimSuffix(path, XenStorePathSeparator) + XenStorePathSeparator
+
+	names := []string{}
+	for p := range *m.values.Load() {
+		if rest, ok := strings.CutPrefix(p, prefix); ok && rest != "" && !strings.Contains(rest, XenStorePathSeparator) {
+			names = append(names, rest)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Snapshot returns a copy of the whole Mirror, keyed by path.
+func (m *Mirror) Snapshot() map[string]string {
+	current := *m.values.Load()
+
+	values := make(map[string]string, len(current))
+	for p, value := range current {
+		values[p] = value
+	}
+
+	return values
+}
+
+// Done returns a channel which is closed once the Mirror stops being updated, either
+// because Close was called or because updating it failed.
+func (m *Mirror) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns the error which stopped the Mirror being updated, or nil if it is still
+// being updated or was stopped using Close.
+func (m *Mirror) Err() error {
+	select {
+	case <-m.done:
+		return m.err
+	default:
+		return nil
+	}
+}
+
+// Close stops updating the Mirror & removes its watch. It must be called even if the
+// Mirror has already stopped because of an error. The contents of the Mirror can
+// still be read afterwards. Close waits for any onChange callback in progress to
+// return, so it deadlocks if called from the callback itself.
+func (m *Mirror) Close() error {
+	var err error
+
+	m.closeOnce.Do(func() {
+		m.halt(nil)
+
+		// The receive goroutine keeps draining the watch until XenStore confirms it
+		// has been removed, after which the Router sends nothing more to it
+		err = m.client.UnWatch(m.root, m.token)
+		if errors.Is(err, ErrRouterStopped) {
+			err = nil
+		}
+
+		close(m.closed)
+		m.workers.Wait()
+	})
+
+	return err
+}
+
+// halt stops the Mirror being updated, recording err as the reason if it is the
+// first.
+func (m *Mirror) halt(err error) {
+	m.stopOnce.Do(func() {
+		m.err = err
+		close(m.stop)
+		close(m.done)
+	})
+}
+
+// receive records the paths of the events received from the watch until the Mirror
+// is closed.
+func (m *Mirror) receive(ch chan *Packet) {
+	defer m.workers.Done()
+
+	for {
+		select {
+		case rsp, ok := <-ch:
+			if !ok {
+				err := m.client.Error()
+				if err == nil {
+					err = ErrConnectionLost
+				}
+				m.halt(err)
+				return
+			}
+
+			if rsp.Header.Op == XsError {
+				m.halt(&OpError{Op: XsWatch.String(), Path: m.root, Err: rsp.Check()})
+				continue
+			}
+
+			if rsp.Header.Op != XsWatchEvent {
+				continue
+			}
+
+			p := rsp.Strings()[0]
+
+			m.lock.Lock()
+			if !m.initial && p == m.root {
+				// XenStore fires every new watch once straight away, which tells us
+				// nothing as the tree is loaded after the watch is set up
+				m.initial = true
+			} else {
+				m.pending[p] = true
+			}
+			m.lock.Unlock()
+
+			select {
+			case m.wake <- struct{}{}:
+			default:
+			}
+
+		case <-m.closed:
+			return
+		}
+	}
+}
+
+// update applies the changes recorded by receive until the Mirror is stopped.
+func (m *Mirror) update() {
+	defer m.workers.Done()
+
+	for {
+		select {
+		case <-m.wake:
+		case <-m.stop:
+			return
+		}
+
+		m.lock.Lock()
+		paths := make([]string, 0, len(m.pending))
+		for p := range m.pending {
+			paths = append(paths, p)
+		}
+		m.pending = map[string]bool{}
+		m.lock.Unlock()
+
+		if len(paths) == 0 {
+			continue
+		}
+		sort.Strings(paths)
+
+		if err := m.refresh(paths); err != nil {
+			m.halt(err)
+			return
+		}
+	}
+}
+
+// refresh re-reads all of paths in a single transaction & applies the differences to
+// the Mirror.
+func (m *Mirror) refresh(paths []string) error {
+	current := *m.values.Load()
+
+	var next map[string]string
+	err := m.client.Transact(func(tx *Transaction) error {
+		next = make(map[string]string, len(current))
+		for p, value := range current {
+			next[p] = value
+		}
+
+		for _, p := range paths {
+			if err := m.refreshPath(tx, current, next, p); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.values.Store(&next)
+
+	if m.onChange != nil {
+		for _, change := range diffMirror(current, next) {
+			m.onChange(change)
+		}
+	}
+
+	return nil
+}
+
+// refreshPath updates next with the current state of p.
+func (m *Mirror) refreshPath(tx *Transaction, current, next map[string]string, p string) error {
+	value, err := tx.Read(p)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		// Removing a node removes all of its descendants without any more events
+		prefix := strings.TrimSuffix(p, XenStorePathSeparator) + XenStorePathSeparator
+		for existing := range next {
+			if existing == p || strings.HasPrefix(existing, prefix) {
+				delete(next, existing)
+			}
+		}
+		return nil
+
+	case errors.Is(err, ErrPermission):
+		delete(next, p)
+		return nil
+
+	case err != nil:
+		return err
+	}
+
+	if _, ok := current[p]; ok {
+		next[p] = value
+		return nil
+	}
+
+	// A new node may have been created along with missing parents & may already have
+	// children if it was created within a transaction
+	if err := m.client.loadTree(p, tx.id, next); err != nil {
+		return err
+	}
+
+	rootPrefix := strings.TrimSuffix(m.root, XenStorePathSeparator) + XenStorePathSeparator
+	for parent := parentPath(p); parent == m.root || strings.HasPrefix(parent, rootPrefix); parent = parentPath(parent) {
+		if _, ok := next[parent]; ok {
+			break
+		}
+
+		value, err := tx.Read(parent)
+		if err != nil {
+			return err
+		}
+		next[parent] = value
+	}
+
+	return nil
+}
+
+// parentPath returns the parent of p, or an empty string if p has no parent.
+func parentPath(p string) string {
+	i := strings.LastIndex(p, XenStorePathSeparator)
+	switch {
+	case i < 0 || p == XenStorePathSeparator:
+		return ""
+	case i == 0:
+		return XenStorePathSeparator
+	}
+
+	return p[:i]
+}
+
+// diffMirror returns the changes between two copies of a Mirror, sorted by path.
+func diffMirror(old, new map[string]string) []MirrorChange {
+	var changes []MirrorChange
+
+	for p, oldValue := range old {
+		newValue, exists := new[p]
+		if !exists || newValue != oldValue {
+			changes = append(changes, MirrorChange{
+				Path:     p,
+				OldValue: oldValue,
+				Existed:  true,
+				NewValue: newValue,
+				Exists:   exists,
+			})
+		}
+	}
+
+	for p, newValue := range new {
+		if _, existed := old[p]; !existed {
+			changes = append(changes, MirrorChange{
+				Path:     p,
+				NewValue: newValue,
+				Exists:   true,
+			})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes
+}
+
+// loadTree reads the values of root & all of its descendants into values, sending
+// all of the requests for each level of the tree before waiting for the replies.
+// Nodes which do not exist or which cannot be read are skipped.
+func (c *Client) loadTree(root string, txid uint32, values map[string]string) error {
+	level := []string{root}
+
+	for len(level) > 0 {
+		read, errs := c.readMany(level, txid)
+		for _, p := range level {
+			if err, ok := errs[p]; ok {
+				if errors.Is(err, ErrNotFound) || errors.Is(err, ErrPermission) {
+					continue
+				}
+				return err
+			}
+
+			values[p] = read[p]
+		}
+
+		children, err := c.listAll(level, txid)
+		if err != nil {
+			return err
+		}
+
+		var next []string
+		for i, p := range level {
+			for _, child := range children[i] {
+				next = append(next, JoinXenStorePath(p, child))
+			}
+		}
+		level = next
+	}
+
+	return nil
+}
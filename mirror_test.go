@@ -0,0 +1,146 @@
+package xenstore_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+// nextChange waits for the next change to be reported by a Mirror.
+func nextChange(t *testing.T, changes chan MirrorChange) MirrorChange {
+	t.Helper()
+
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a change")
+		return MirrorChange{}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	writer := store.Client()
+	defer writer.Close()
+
+	for p, value := range map[string]string{
+		"/local/domain/5/name":               "guest",
+		"/local/domain/5/device/vif/0/state": "1",
+		"/local/domain/6/name":               "other",
+	} {
+		if _, err := writer.Write(p, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := store.Client()
+	defer c.Close()
+
+	changes := make(chan MirrorChange, 16)
+	m, err := NewMirror(c, "/local/domain/5", func(change MirrorChange) {
+		changes <- change
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"/local/domain/5":                    "",
+		"/local/domain/5/name":               "guest",
+		"/local/domain/5/device":             "",
+		"/local/domain/5/device/vif":         "",
+		"/local/domain/5/device/vif/0":       "",
+		"/local/domain/5/device/vif/0/state": "1",
+	}, m.Snapshot())
+	assert.Equal(t, []string{"device", "name"}, m.List("/local/domain/5"))
+
+	// Changing a value
+	if _, err := writer.Write("/local/domain/5/device/vif/0/state", "4"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, MirrorChange{
+		Path:     "/local/domain/5/device/vif/0/state",
+		OldValue: "1",
+		Existed:  true,
+		NewValue: "4",
+		Exists:   true,
+	}, nextChange(t, changes))
+
+	value, ok := m.Read("/local/domain/5/device/vif/0/state")
+	assert.True(t, ok)
+	assert.Equal(t, "4", value)
+
+	// Creating a node along with a missing parent
+	if _, err := writer.Write("/local/domain/5/data/key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, MirrorChange{Path: "/local/domain/5/data", Exists: true}, nextChange(t, changes))
+	assert.Equal(t, MirrorChange{Path: "/local/domain/5/data/key", NewValue: "value", Exists: true}, nextChange(t, changes))
+
+	// Removing a subtree
+	if _, err := writer.Remove("/local/domain/5/device"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{
+		"/local/domain/5/device",
+		"/local/domain/5/device/vif",
+		"/local/domain/5/device/vif/0",
+		"/local/domain/5/device/vif/0/state",
+	} {
+		change := nextChange(t, changes)
+		assert.Equal(t, p, change.Path)
+		assert.True(t, change.Existed)
+		assert.False(t, change.Exists)
+	}
+
+	_, ok = m.Read("/local/domain/5/device/vif/0/state")
+	assert.False(t, ok)
+
+	// Changes outside of the root are not seen
+	if _, err := writer.Write("/local/domain/6/name", "changed"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, m.Close())
+	assert.NoError(t, m.Err())
+	assert.Zero(t, c.WatchCount())
+
+	select {
+	case change := <-changes:
+		t.Errorf("unexpected change %+v", change)
+	default:
+	}
+
+	// The contents are still readable after closing
+	value, ok = m.Read("/local/domain/5/name")
+	assert.True(t, ok)
+	assert.Equal(t, "guest", value)
+}
+
+func TestMirrorConnectionLost(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+
+	m, err := NewMirror(c, "/local/domain/5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+
+	select {
+	case <-m.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirror did not stop")
+	}
+
+	assert.Error(t, m.Err())
+	assert.NoError(t, m.Close())
+}
@@ -0,0 +1,345 @@
+package xenstore
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Node is a XenStore node along with all of its descendants. It is the format used
+// by Client.Snapshot & Client.Sync and can be stored as JSON.
+type Node struct {
+	Value string `json:"value"`
+	// Perms are the permissions of the node in the same format as SetPermissions
+	// accepts. nil means the permissions are not known, or should not be changed by
+	// Sync.
+	Perms    []string         `json:"perms,omitempty"`
+	Children map[string]*Node `json:"children,omitempty"`
+}
+
+// DiffKind is the type of difference described by a DiffEntry.
+type DiffKind int
+
+const (
+	// DiffAdded means the node exists only in the second tree.
+	DiffAdded DiffKind = iota + 1
+	// DiffRemoved means the node exists only in the first tree.
+	DiffRemoved
+	// DiffChanged means the node exists in both trees with a different value or
+	// different permissions.
+	DiffChanged
+)
+
+var diffKindNames = map[DiffKind]string{
+	DiffAdded:   "added",
+	DiffRemoved: "removed",
+	DiffChanged: "changed",
+}
+
+func (k DiffKind) String() string {
+	if name, ok := diffKindNames[k]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown(%d)", int(k))
+}
+
+// MarshalText implements encoding.TextMarshaler so that DiffKind is stored by name.
+func (k DiffKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// DiffEntry is a single difference between two trees of Nodes.
+type DiffEntry struct {
+	Kind DiffKind `json:"kind"`
+	// Path is relative to the roots of the trees, with "" for the roots themselves.
+	Path     string   `json:"path"`
+	OldValue string   `json:"old_value,omitempty"`
+	NewValue string   `json:"new_value,omitempty"`
+	OldPerms []string `json:"old_perms,omitempty"`
+	NewPerms []string `json:"new_perms,omitempty"`
+}
+
+// Diff returns the differences needed to turn the tree a into the tree b, sorted by
+// path so that parents come before their children. Every node of an added or removed
+// subtree has its own entry. Permissions are only compared when they are known for
+// both nodes.
+func Diff(a, b Node) []DiffEntry {
+	return diffNodes(&a, &b)
+}
+
+func diffNodes(a, b *Node) []DiffEntry {
+	var entries []DiffEntry
+	diffNode("", a, b, &entries)
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	return entries
+}
+
+// diffNode appends the differences between a & b, either of which may be nil, to
+// entries.
+func diffNode(p string, a, b *Node, entries *[]DiffEntry) {
+	switch {
+	case a == nil && b == nil:
+		return
+
+	case a == nil:
+		*entries = append(*entries, DiffEntry{Kind: DiffAdded, Path: p, NewValue: b.Value, NewPerms: b.Perms})
+
+	case b == nil:
+		*entries = append(*entries, DiffEntry{Kind: DiffRemoved, Path: p, OldValue: a.Value, OldPerms: a.Perms})
+
+	case a.Value != b.Value || (a.Perms != nil && b.Perms != nil && !equalPerms(a.Perms, b.Perms)):
+		*entries = append(*entries, DiffEntry{
+			Kind:     DiffChanged,
+			Path:     p,
+			OldValue: a.Value,
+			NewValue: b.Value,
+			OldPerms: a.Perms,
+			NewPerms: b.Perms,
+		})
+	}
+
+	names := map[string]bool{}
+	for _, n := range []*Node{a, b} {
+		if n != nil {
+			for name := range n.Children {
+				names[name] = true
+			}
+		}
+	}
+
+	for name := range names {
+		var childA, childB *Node
+		if a != nil {
+			childA = a.Children[name]
+		}
+		if b != nil {
+			childB = b.Children[name]
+		}
+
+		diffNode(path.Join(p, name), childA, childB, entries)
+	}
+}
+
+func equalPerms(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Snapshot reads the subtree below p, including the permissions of every node, using
+// a transaction so that the copy is consistent. Nodes which the connection is not
+// allowed to read are left out.
+func (c *Client) Snapshot(p string) (*Node, error) {
+	var root *Node
+
+	err := c.Transact(func(tx *Transaction) error {
+		var err error
+		root, err = c.snapshot(p, tx.id)
+		return err
+	})
+
+	return root, err
+}
+
+// Snapshot reads the subtree below p within the Transaction. See Client.Snapshot.
+func (t *Transaction) Snapshot(p string) (*Node, error) {
+	return t.client.snapshot(p, t.id)
+}
+
+// snapshot reads the subtree below root within the transaction txid, sending all of
+// the requests for each level of the tree before waiting for any of the replies.
+func (c *Client) snapshot(root string, txid uint32) (*Node, error) {
+	type request struct {
+		pkt *Packet
+		ch  chan *Packet
+	}
+
+	type pendingNode struct {
+		path     string
+		name     string
+		node     *Node
+		parent   *Node
+		requests [3]request
+	}
+
+	rootNode := &Node{}
+	level := []*pendingNode{{path: root, node: rootNode}}
+
+	for len(level) > 0 {
+		for _, pending := range level {
+			for i, op := range []Operation{XsRead, XsGetPermissions, XsDirectory} {
+				p, ch, err := c.sendBytes(op, append([]byte(pending.path), NUL), txid)
+				if err != nil {
+					return nil, err
+				}
+
+				pending.requests[i] = request{p, ch}
+			}
+		}
+
+		var next []*pendingNode
+		var firstErr error
+
+		// Wait for every reply, even after an error, so none are left to time out
+		for _, pending := range level {
+			var replies [3]*Packet
+			var skipErr error
+
+			for i, req := range pending.requests {
+				rsp, err := c.waitReply(req.pkt, req.ch)
+				switch {
+				case err == nil:
+					replies[i] = rsp
+				case errors.Is(err, ErrNotFound), errors.Is(err, ErrPermission):
+					skipErr = err
+				case firstErr == nil:
+					firstErr = err
+				}
+			}
+
+			if skipErr != nil {
+				// The root must be readable, but its descendants may have been removed
+				// since they were listed or be hidden from this connection
+				if pending.parent == nil {
+					firstErr = skipErr
+				} else {
+					delete(pending.parent.Children, pending.name)
+				}
+				continue
+			}
+
+			if firstErr != nil {
+				continue
+			}
+
+			pending.node.Value = replies[0].payloadString()
+			pending.node.Perms = replies[1].Strings()
+
+			if children := replies[2].payloadString(); children != "" {
+				pending.node.Children = map[string]*Node{}
+
+				for _, name := range strings.Split(children, "\x00") {
+					child := &Node{}
+					pending.node.Children[name] = child
+					next = append(next, &pendingNode{
+						path:   JoinXenStorePath(pending.path, name),
+						name:   name,
+						node:   child,
+						parent: pending.node,
+					})
+				}
+			}
+		}
+
+		if firstErr != nil {
+			return nil, firstErr
+		}
+
+		level = next
+	}
+
+	return rootNode, nil
+}
+
+// Sync changes the subtree below p to match desired using a single transaction,
+// which is retried if it conflicts with another change. Only the nodes which differ
+// are written or removed; the permissions of a node are only set if they are given in
+// desired. If p does not exist it is created. The changes which were applied are
+// returned.
+func (c *Client) Sync(p string, desired *Node) ([]DiffEntry, error) {
+	var applied []DiffEntry
+
+	err := c.Transact(func(tx *Transaction) error {
+		var err error
+		applied, err = tx.Sync(p, desired)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
+
+// Sync changes the subtree below p to match desired within the Transaction. See
+// Client.Sync.
+func (t *Transaction) Sync(p string, desired *Node) ([]DiffEntry, error) {
+	current, err := t.client.snapshot(p, t.id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	entries := diffNodes(current, desired)
+
+	// Removing a node removes all of its descendants, so only the top of each removed
+	// subtree needs a request. Entries are sorted so parents come before children.
+	var removed []string
+	for _, entry := range entries {
+		if entry.Kind != DiffRemoved || withinAny(entry.Path, removed) {
+			continue
+		}
+
+		if _, err := t.Remove(syncPath(p, entry.Path)); err != nil {
+			return nil, err
+		}
+		removed = append(removed, entry.Path)
+	}
+
+	for _, entry := range entries {
+		if entry.Kind == DiffRemoved {
+			continue
+		}
+
+		target := syncPath(p, entry.Path)
+
+		if entry.Kind == DiffAdded || entry.OldValue != entry.NewValue {
+			if _, err := t.Write(target, entry.NewValue); err != nil {
+				return nil, err
+			}
+		}
+
+		if entry.NewPerms != nil && (entry.Kind == DiffAdded || !equalPerms(entry.OldPerms, entry.NewPerms)) {
+			if _, err := t.SetPermissions(target, entry.NewPerms); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// syncPath returns the full path of the node at the relative path rel below root.
+func syncPath(root, rel string) string {
+	if rel == "" {
+		return root
+	}
+
+	return JoinXenStorePath(root, rel)
+}
+
+// withinAny reports whether the relative path p is one of parents or a descendant of
+// one of them.
+func withinAny(p string, parents []string) bool {
+	for _, parent := range parents {
+		if parent == "" || p == parent || strings.HasPrefix(p, parent+XenStorePathSeparator) {
+			return true
+		}
+	}
+
+	return false
+}
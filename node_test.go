@@ -0,0 +1,150 @@
+package xenstore_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	a := Node{
+		Perms: []string{"n0"},
+		Children: map[string]*Node{
+			"name":  {Value: "guest", Perms: []string{"n0"}},
+			"state": {Value: "1", Perms: []string{"n0"}},
+			"device": {Children: map[string]*Node{
+				"vif": {Value: "old"},
+			}},
+		},
+	}
+
+	b := Node{
+		Perms: []string{"n0", "r5"},
+		Children: map[string]*Node{
+			"name":  {Value: "guest", Perms: []string{"b5"}},
+			"state": {Value: "4"},
+			"data":  {Value: "new", Perms: []string{"n5"}},
+		},
+	}
+
+	assert.Equal(t, []DiffEntry{
+		{Kind: DiffChanged, Path: "", OldPerms: []string{"n0"}, NewPerms: []string{"n0", "r5"}},
+		{Kind: DiffAdded, Path: "data", NewValue: "new", NewPerms: []string{"n5"}},
+		{Kind: DiffRemoved, Path: "device"},
+		{Kind: DiffRemoved, Path: "device/vif", OldValue: "old"},
+		{Kind: DiffChanged, Path: "name", OldValue: "guest", NewValue: "guest", OldPerms: []string{"n0"}, NewPerms: []string{"b5"}},
+		{Kind: DiffChanged, Path: "state", OldValue: "1", NewValue: "4", OldPerms: []string{"n0"}},
+	}, Diff(a, b))
+
+	assert.Empty(t, Diff(a, a))
+
+	encoded, err := json.Marshal(Diff(Node{}, Node{Value: "x"}))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"kind":"changed","path":"","new_value":"x"}]`, string(encoded))
+}
+
+func TestClientSnapshot(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+	c := store.Client()
+	defer c.Close()
+
+	for p, value := range map[string]string{
+		"/vm/1/name":          "guest",
+		"/vm/1/device/vif/0":  "mac",
+		"/vm/1/device/vbd/51": "disk",
+	} {
+		if _, err := c.Write(p, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.SetPermissions("/vm/1/name", []string{"n0", "r5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := c.Snapshot("/vm/1")
+	assert.NoError(t, err)
+	assert.Equal(t, &Node{
+		Perms: []string{"n0"},
+		Children: map[string]*Node{
+			"name": {Value: "guest", Perms: []string{"n0", "r5"}},
+			"device": {Perms: []string{"n0"}, Children: map[string]*Node{
+				"vif": {Perms: []string{"n0"}, Children: map[string]*Node{
+					"0": {Value: "mac", Perms: []string{"n0"}},
+				}},
+				"vbd": {Perms: []string{"n0"}, Children: map[string]*Node{
+					"51": {Value: "disk", Perms: []string{"n0"}},
+				}},
+			}},
+		},
+	}, node)
+
+	_, err = c.Snapshot("/vm/2")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestClientSync(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	for p, value := range map[string]string{
+		"/vm/1/name":          "guest",
+		"/vm/1/state":         "1",
+		"/vm/1/device/vif/0":  "mac",
+		"/vm/1/device/vbd/51": "disk",
+	} {
+		if _, err := c.Write(p, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	desired := &Node{
+		Children: map[string]*Node{
+			"name":  {Value: "guest"},
+			"state": {Value: "4", Perms: []string{"n0", "r5"}},
+			"device": {Children: map[string]*Node{
+				"vbd": {Children: map[string]*Node{
+					"51": {Value: "disk"},
+					"52": {Value: "cdrom"},
+				}},
+			}},
+		},
+	}
+
+	applied, err := c.Sync("/vm/1", desired)
+	assert.NoError(t, err)
+
+	var summary []string
+	for _, entry := range applied {
+		summary = append(summary, entry.Kind.String()+" "+entry.Path)
+	}
+	assert.Equal(t, []string{
+		"added device/vbd/52",
+		"removed device/vif",
+		"removed device/vif/0",
+		"changed state",
+	}, summary)
+
+	node, err := c.Snapshot("/vm/1")
+	assert.NoError(t, err)
+	assert.Empty(t, Diff(*node, *desired))
+	assert.Equal(t, []string{"n0", "r5"}, node.Children["state"].Perms)
+
+	// Nothing is changed the second time around
+	applied, err = c.Sync("/vm/1", desired)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	// Syncing to a path which does not exist creates it
+	applied, err = c.Sync("/vm/2", &Node{Value: "new", Children: map[string]*Node{"name": {Value: "other"}}})
+	assert.NoError(t, err)
+	assert.Len(t, applied, 2)
+
+	value, err := c.Read("/vm/2/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "other", value)
+}
@@ -0,0 +1,107 @@
+package xenstore
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Logger is the interface used by a Client to report problems which cannot be returned
+// to a caller, such as packets which arrive for a request nobody is waiting on. It is
+// satisfied by *logrus.Logger and *logrus.Entry.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// ReconnectPolicy controls how a Client replaces its Transport if receiving from it
+// fails. Requests which are in flight when the connection is lost fail with
+// ErrConnectionLost but watches are registered again on the new Transport.
+type ReconnectPolicy struct {
+	// Dial creates a new Transport to replace the one which failed.
+	Dial func() (Transport, error)
+	// MaxAttempts is the number of times to call Dial before giving up. Zero means
+	// keep trying until the Client is closed.
+	MaxAttempts int
+	// Backoff is the delay before the first attempt, doubled after each failure.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between attempts. Zero means no limit.
+	MaxBackoff time.Duration
+}
+
+// ClientOption configures optional behaviour of a Client created by NewClient.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	requestTimeout  time.Duration
+	watchBufferSize int
+	logger          Logger
+	orphanHandler   func(*Packet)
+	reconnect       *ReconnectPolicy
+	observer        Observer
+	watchTokens     func() string
+}
+
+func defaultClientOptions() clientOptions {
+	return clientOptions{
+		logger: log.StandardLogger(),
+	}
+}
+
+// WithRequestTimeout sets the maximum time to wait for XenStore to reply to a request
+// before returning ErrRequestTimeout. The default is to wait forever.
+func WithRequestTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.requestTimeout = d
+	}
+}
+
+// WithWatchBufferSize sets the capacity of the channels returned by Client.Watch. The
+// default is an unbuffered channel.
+func WithWatchBufferSize(n int) ClientOption {
+	return func(o *clientOptions) {
+		o.watchBufferSize = n
+	}
+}
+
+// WithWatchTokens sets the function which generates the tokens of the watches the
+// Client sets up itself, for WaitFor, NewMirror & Lock. Each token must be unique among
+// the watches of the Client. The default is made up of the process ID & a counter, so
+// a deterministic function is needed for a recording of the requests to be replayed.
+func WithWatchTokens(next func() string) ClientOption {
+	return func(o *clientOptions) {
+		o.watchTokens = next
+	}
+}
+
+// WithLogger sets the Logger used by the Client. The default is the standard logrus
+// logger.
+func WithLogger(l Logger) ClientOption {
+	return func(o *clientOptions) {
+		o.logger = l
+	}
+}
+
+// WithOrphanPacketHandler sets a function which is called with any packet received
+// from XenStore which does not match an outstanding request or watch, such as a reply
+// which arrives after its request timed out. By default these are logged and dropped.
+func WithOrphanPacketHandler(f func(*Packet)) ClientOption {
+	return func(o *clientOptions) {
+		o.orphanHandler = f
+	}
+}
+
+// WithReconnectPolicy enables reconnecting to XenStore if the Transport fails.
+func WithReconnectPolicy(p ReconnectPolicy) ClientOption {
+	return func(o *clientOptions) {
+		o.reconnect = &p
+	}
+}
+
+// WithObserver sets an Observer which is notified about all traffic handled by the
+// Client.
+func WithObserver(obs Observer) ClientOption {
+	return func(o *clientOptions) {
+		o.observer = obs
+	}
+}
@@ -1,31 +1,90 @@
 package xenstore
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"unsafe"
-
-	"github.com/lunixbochs/struc"
 )
 
 const PacketHeaderSize = unsafe.Sizeof(PacketHeader{})
 
+// MaxPayloadSize is the largest payload which XenStore accepts in a single Packet.
+const MaxPayloadSize = 4096
+
+// packetBuffers holds buffers large enough for any valid Packet so that encoding &
+// decoding does not need to allocate.
+var packetBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, PacketHeaderSize+MaxPayloadSize)
+		return &b
+	},
+}
+
 type PacketHeader struct {
-	Op     xenStoreOperation `struc:"uint32,little"`
-	RqId   uint32            `struc:"uint32,little"`
-	TxId   uint32            `struc:"uint32,little"`
-	Length uint32            `struc:"uint32,little"`
+	Op     Operation
+	RqId   uint32
+	TxId   uint32
+	Length uint32
 }
 
 // Pack the PacketHeader struct and Write the data to an io.Writer
 func (h *PacketHeader) Pack(w io.Writer) error {
-	return struc.Pack(w, h)
+	bp := packetBuffers.Get().(*[]byte)
+	defer packetBuffers.Put(bp)
+
+	buf := (*bp)[:PacketHeaderSize]
+	h.put(buf)
+
+	_, err := w.Write(buf)
+	return err
 }
 
+// Unpack reads exactly PacketHeaderSize bytes from an io.Reader into the PacketHeader.
 func (h *PacketHeader) Unpack(r io.Reader) error {
-	return struc.Unpack(r, h)
+	bp := packetBuffers.Get().(*[]byte)
+	defer packetBuffers.Put(bp)
+
+	buf := (*bp)[:PacketHeaderSize]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+
+	h.get(buf)
+	return nil
+}
+
+// Validate checks that the header describes a Packet which could have been sent by
+// XenStore, returning a *FramingError if not.
+func (h *PacketHeader) Validate() error {
+	if h.Length > MaxPayloadSize {
+		return &FramingError{Header: *h, Err: ErrPayloadTooLarge}
+	}
+
+	if _, ok := operationNames[h.Op]; !ok || h.Op == XsInvalid {
+		return &FramingError{Header: *h, Err: ErrInvalidOperation}
+	}
+
+	return nil
+}
+
+// put encodes the header into the first PacketHeaderSize bytes of buf.
+func (h *PacketHeader) put(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(h.Op))
+	binary.LittleEndian.PutUint32(buf[4:8], h.RqId)
+	binary.LittleEndian.PutUint32(buf[8:12], h.TxId)
+	binary.LittleEndian.PutUint32(buf[12:16], h.Length)
+}
+
+// get decodes the header from the first PacketHeaderSize bytes of buf.
+func (h *PacketHeader) get(buf []byte) {
+	h.Op = Operation(binary.LittleEndian.Uint32(buf[0:4]))
+	h.RqId = binary.LittleEndian.Uint32(buf[4:8])
+	h.TxId = binary.LittleEndian.Uint32(buf[8:12])
+	h.Length = binary.LittleEndian.Uint32(buf[12:16])
 }
 
 type Packet struct {
@@ -34,8 +93,8 @@ type Packet struct {
 }
 
 // NewPacket creates a new Packet instance for sending a payload to XenStore
-func NewPacket(op xenStoreOperation, payload []byte, txid uint32) (*Packet, error) {
-	if l := len(payload); l > 4096 {
+func NewPacket(op Operation, payload []byte, txid uint32) (*Packet, error) {
+	if l := len(payload); l > MaxPayloadSize {
 		return nil, fmt.Errorf("payload too long: %d", l)
 	}
 
@@ -50,27 +109,32 @@ func NewPacket(op xenStoreOperation, payload []byte, txid uint32) (*Packet, erro
 	}, nil
 }
 
+// Pack writes the Packet to an io.Writer using a single call to Write.
 func (p *Packet) Pack(w io.Writer) error {
 	p.Header.Length = uint32(len(p.Payload))
 
-	if err := p.Header.Pack(w); err != nil {
-		return err
-	}
-
-	size := int(p.Header.Length)
+	size := int(PacketHeaderSize) + len(p.Payload)
 
-	for written := 0; written < size; {
-		sb, err := w.Write(p.Payload[written:])
-		if err != nil {
-			return err
-		}
+	bp := packetBuffers.Get().(*[]byte)
+	defer packetBuffers.Put(bp)
 
-		written += sb
+	buf := *bp
+	if size > len(buf) {
+		buf = make([]byte, size)
 	}
+	buf = buf[:size]
 
-	return nil
+	p.Header.put(buf)
+	copy(buf[PacketHeaderSize:], p.Payload)
+
+	_, err := w.Write(buf)
+	return err
 }
 
+// Unpack reads a whole Packet from an io.Reader, returning io.ErrUnexpectedEOF if the
+// reader ends part of the way through. A *FramingError is returned without reading
+// the payload if the header is not valid, after which the position in the stream is
+// lost & the reader should not be used again.
 func (p *Packet) Unpack(r io.Reader) error {
 	if p.Header == nil {
 		p.Header = &PacketHeader{}
@@ -80,23 +144,18 @@ func (p *Packet) Unpack(r io.Reader) error {
 		return err
 	}
 
-	size := int(p.Header.Length)
-	p.Payload = make([]byte, 0)
-
-	for size > 0 {
-		var buf = make([]byte, size)
+	if err := p.Header.Validate(); err != nil {
+		return err
+	}
 
-		n, err := r.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+	p.Payload = make([]byte, p.Header.Length)
 
-			return err
+	if _, err := io.ReadFull(r, p.Payload); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
 		}
 
-		p.Payload = append(p.Payload, buf[:n]...)
-		size -= n
+		return err
 	}
 
 	return nil
@@ -2,9 +2,11 @@ package xenstore
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"testing"
 
+	"github.com/lunixbochs/struc"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -105,3 +107,250 @@ func TestPacketPackUnpack(t *testing.T) {
 
 	assert.Equal(t, p1.Payload, p2.Payload)
 }
+
+// strucHeader is the reflection-based encoding of PacketHeader used by earlier versions
+// of this package, which the hand-written codec must remain byte-identical to.
+type strucHeader struct {
+	Op     uint32 `struc:"uint32,little"`
+	RqId   uint32 `struc:"uint32,little"`
+	TxId   uint32 `struc:"uint32,little"`
+	Length uint32 `struc:"uint32,little"`
+}
+
+func FuzzPacketHeaderPack(f *testing.F) {
+	f.Add(uint32(XsRead), uint32(0), uint32(0), uint32(4))
+	f.Add(uint32(XsInvalid), ^uint32(0), uint32(9), ^uint32(0))
+
+	f.Fuzz(func(t *testing.T, op, rqid, txid, length uint32) {
+		h := &PacketHeader{Op: Operation(op), RqId: rqid, TxId: txid, Length: length}
+
+		got := bytes.NewBuffer([]byte{})
+		if err := h.Pack(got); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := bytes.NewBuffer([]byte{})
+		if err := struc.Pack(expected, &strucHeader{op, rqid, txid, length}); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, expected.Bytes(), got.Bytes())
+
+		h2 := &PacketHeader{}
+		if err := h2.Unpack(got); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, h, h2)
+	})
+}
+
+func FuzzPacketPack(f *testing.F) {
+	f.Add(uint32(XsWrite), uint32(3), []byte("/local/domain/0/name\x00Domain-0"))
+	f.Add(uint32(XsDirectory), uint32(0), []byte{})
+
+	f.Fuzz(func(t *testing.T, op, txid uint32, payload []byte) {
+		if len(payload) > MaxPayloadSize {
+			t.Skip()
+		}
+
+		p, err := NewPacket(Operation(op), payload, txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := bytes.NewBuffer([]byte{})
+		if err := p.Pack(got); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := bytes.NewBuffer([]byte{})
+		h := p.Header
+		if err := struc.Pack(expected, &strucHeader{uint32(h.Op), h.RqId, h.TxId, h.Length}); err != nil {
+			t.Fatal(err)
+		}
+		expected.Write(payload)
+
+		assert.Equal(t, expected.Bytes(), got.Bytes())
+
+		p2 := &Packet{}
+		if err := p2.Unpack(got); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, p.Header, p2.Header)
+		assert.Equal(t, len(payload), len(p2.Payload))
+		assert.True(t, bytes.Equal(payload, p2.Payload))
+	})
+}
+
+func BenchmarkPacketPack(b *testing.B) {
+	p, err := NewPacket(XsWrite, []byte("/local/domain/0/data/example\x00some value"), 0x0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := p.Pack(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPacketUnpack(b *testing.B) {
+	p, err := NewPacket(XsWatchEvent, []byte("/local/domain/0/data/example\x00token\x00"), 0x0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	if err := p.Pack(buf); err != nil {
+		b.Fatal(err)
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	p2 := &Packet{}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(buf.Bytes())
+
+		if err := p2.Unpack(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStrucHeaderPack(b *testing.B) {
+	h := &strucHeader{uint32(XsWrite), 1, 0, 40}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := struc.Pack(io.Discard, h); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPacketUnpackTruncated(t *testing.T) {
+	p, err := NewPacket(XsRead, []byte("/local/domain/0/name\x00"), 0x0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := bytes.NewBuffer([]byte{})
+	if err := p.Pack(b); err != nil {
+		t.Fatal(err)
+	}
+	encoded := b.Bytes()
+
+	// Nothing at all is a clean EOF
+	assert.Equal(t, io.EOF, (&Packet{}).Unpack(bytes.NewReader([]byte{})))
+
+	for _, n := range []int{1, int(PacketHeaderSize) - 1, int(PacketHeaderSize), len(encoded) - 1} {
+		err := (&Packet{}).Unpack(bytes.NewReader(encoded[:n]))
+		assert.Equal(t, io.ErrUnexpectedEOF, err, "truncated to %d bytes", n)
+	}
+}
+
+func TestPacketUnpackInvalidHeader(t *testing.T) {
+	tooLong := bytes.NewBuffer([]byte{})
+	(&PacketHeader{Op: XsRead, Length: MaxPayloadSize + 1}).Pack(tooLong)
+
+	err := (&Packet{}).Unpack(tooLong)
+	assert.True(t, errors.Is(err, ErrPayloadTooLarge))
+
+	var framingErr *FramingError
+	if assert.True(t, errors.As(err, &framingErr)) {
+		assert.Equal(t, uint32(MaxPayloadSize+1), framingErr.Header.Length)
+	}
+
+	badOp := bytes.NewBuffer([]byte{})
+	(&PacketHeader{Op: XsResetWatches + 1}).Pack(badOp)
+	assert.True(t, errors.Is((&Packet{}).Unpack(badOp), ErrInvalidOperation))
+}
+
+func FuzzPacketUnpack(f *testing.F) {
+	for _, op := range []Operation{XsRead, XsWatchEvent, XsError} {
+		p, _ := NewPacket(op, []byte("/local/domain/0/name\x00"), 0x1)
+		b := bytes.NewBuffer([]byte{})
+		p.Pack(b)
+		f.Add(b.Bytes())
+	}
+	f.Add([]byte("\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := &Packet{}
+		if err := p.Unpack(bytes.NewReader(data)); err != nil {
+			return
+		}
+
+		if p.Header.Length > MaxPayloadSize || int(p.Header.Length) != len(p.Payload) {
+			t.Fatalf("unpacked invalid packet: %+v", p.Header)
+		}
+
+		// A successfully unpacked packet must encode back to exactly the bytes read
+		b := bytes.NewBuffer([]byte{})
+		if err := p.Pack(b); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, data[:b.Len()], b.Bytes())
+	})
+}
+
+// loopReader serves the same bytes forever.
+type loopReader struct {
+	data []byte
+	pos  int
+}
+
+func (l *loopReader) Read(b []byte) (int, error) {
+	n := copy(b, l.data[l.pos:])
+	l.pos = (l.pos + n) % len(l.data)
+	return n, nil
+}
+
+func (l *loopReader) Write(b []byte) (int, error) { return len(b), nil }
+
+func (l *loopReader) Close() error { return nil }
+
+func BenchmarkReadWriteTransportReceive(b *testing.B) {
+	p, err := NewPacket(XsWatchEvent, []byte("/local/domain/0/data/example\x00token\x00"), 0x0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	if err := p.Pack(buf); err != nil {
+		b.Fatal(err)
+	}
+
+	t := NewReadWriteTransport(&loopReader{data: buf.Bytes()})
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := t.Receive(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadWriteTransportSend(b *testing.B) {
+	p, err := NewPacket(XsWrite, []byte("/local/domain/0/data/example\x00some value"), 0x0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	t := NewReadWriteTransport(&loopReader{data: []byte{0}})
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := t.Send(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package xenstore
+
+import "net"
+
+func unixPeerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,329 @@
+package xenstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrProxyClosed is returned by Proxy.Serve & Proxy.ServeConn once the Proxy has been
+// closed.
+var ErrProxyClosed = errors.New("proxy closed")
+
+// proxyPathOps are the operations whose first argument is a path, which are checked
+// against ProxyConfig.AllowPaths. Once AllowPaths is set any other operation has to
+// be listed in ProxyConfig.AllowOps, as some of them, such as introduce & set_target,
+// change the domains XenStore knows about.
+var proxyPathOps = map[Operation]bool{
+	XsDirectory:      true,
+	XsRead:           true,
+	XsGetPermissions: true,
+	XsWatch:          true,
+	XsUnWatch:        true,
+	XsWrite:          true,
+	XsMkdir:          true,
+	XsRm:             true,
+	XsSetPermissions: true,
+}
+
+// ProxyConfig configures a Proxy created by NewProxy.
+type ProxyConfig struct {
+	// Dial creates the connection to XenStore used by a single client. Every client
+	// has its own connection so that their watches & transactions are kept apart.
+	Dial func() (Transport, error)
+	// AllowOps are the names of the operations clients may use, such as "read" or
+	// "watch", as accepted by ParseOperation. Nil allows every operation, except as
+	// limited by AllowPaths.
+	AllowOps []string
+	// AllowPaths are patterns, in the syntax accepted by Client.Glob, matching the
+	// paths which clients may access. Nil allows every path. Relative paths are only
+	// allowed by relative patterns, as the Proxy cannot tell which domain they are
+	// relative to. Operations which do not take a path, such as transaction_start,
+	// are denied unless they are listed in AllowOps.
+	AllowPaths []string
+	// Logger reports denied requests & clients whose connection fails. The default is
+	// the standard logrus logger.
+	Logger Logger
+}
+
+// Proxy forwards the Packets sent by clients over a network, typically using a
+// TCPTransport, to XenStore on the local host. Requests which are not allowed by the
+// ProxyConfig are answered with ErrPermission without being forwarded.
+type Proxy struct {
+	cfg ProxyConfig
+	ops map[Operation]bool
+
+	lock      sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[*proxyConn]struct{}
+	active    sync.WaitGroup
+}
+
+// NewProxy creates a Proxy, checking that the operations in cfg.AllowOps & the
+// patterns in cfg.AllowPaths are valid.
+func NewProxy(cfg ProxyConfig) (*Proxy, error) {
+	if cfg.Dial == nil {
+		return nil, errors.New("proxy: Dial must be set")
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = log.StandardLogger()
+	}
+
+	for _, pattern := range cfg.AllowPaths {
+		if _, err := MatchGlob(pattern, XenStorePathSeparator); err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+	}
+
+	p := &Proxy{
+		cfg:       cfg,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[*proxyConn]struct{}{},
+	}
+
+	if cfg.AllowOps != nil {
+		p.ops = map[Operation]bool{}
+		for _, name := range cfg.AllowOps {
+			op, err := ParseOperation(name)
+			if err != nil {
+				return nil, fmt.Errorf("proxy: %w", err)
+			}
+			p.ops[op] = true
+		}
+	}
+
+	return p, nil
+}
+
+// Serve accepts connections from l, serving each of them in a new goroutine, until the
+// Proxy is closed or accepting fails. l is closed when Serve returns. To use TLS, wrap
+// l using tls.NewListener.
+func (p *Proxy) Serve(l net.Listener) error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		l.Close()
+		return ErrProxyClosed
+	}
+	p.listeners[l] = struct{}{}
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		delete(p.listeners, l)
+		p.lock.Unlock()
+
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.isClosed() {
+				return ErrProxyClosed
+			}
+			return err
+		}
+
+		go func() {
+			if err := p.ServeConn(conn); err != nil && !errors.Is(err, ErrProxyClosed) {
+				p.cfg.Logger.Warnf("proxy connection from %s failed: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn forwards the requests received from a single client on conn until either
+// side closes its connection, returning nil if it was closed cleanly.
+func (p *Proxy) ServeConn(conn io.ReadWriteCloser) error {
+	backend, err := p.cfg.Dial()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	pc := &proxyConn{
+		proxy:   p,
+		client:  NewReadWriteTransport(conn),
+		backend: backend,
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		pc.close()
+		return ErrProxyClosed
+	}
+	p.conns[pc] = struct{}{}
+	p.active.Add(1)
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		delete(p.conns, pc)
+		p.lock.Unlock()
+
+		p.active.Done()
+	}()
+
+	return pc.run()
+}
+
+// Close stops every call to Serve, closes the connections of all of the clients &
+// waits for them to finish.
+func (p *Proxy) Close() error {
+	p.lock.Lock()
+	p.closed = true
+
+	var err error
+	for l := range p.listeners {
+		if lerr := l.Close(); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+
+	for pc := range p.conns {
+		pc.close()
+	}
+	p.lock.Unlock()
+
+	p.active.Wait()
+
+	return err
+}
+
+func (p *Proxy) isClosed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.closed
+}
+
+// allowed reports whether req may be forwarded to XenStore.
+func (p *Proxy) allowed(req *Packet) bool {
+	if p.ops != nil && !p.ops[req.Header.Op] {
+		return false
+	}
+
+	if p.cfg.AllowPaths == nil {
+		return true
+	}
+
+	if !proxyPathOps[req.Header.Op] {
+		// Only allowed if listed in AllowOps, which was checked above
+		return p.ops != nil
+	}
+
+	target := req.Strings()[0]
+	for _, pattern := range p.cfg.AllowPaths {
+		// The patterns were checked by NewProxy so this cannot fail
+		if ok, _ := MatchGlob(pattern, target); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyConn is a single client of a Proxy along with its connection to XenStore.
+type proxyConn struct {
+	proxy   *Proxy
+	client  *ReadWriteTransport
+	backend Transport
+
+	// writeLock serialises the replies forwarded from XenStore with those sent by the
+	// Proxy itself.
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+func (pc *proxyConn) run() error {
+	errs := make(chan error, 2)
+
+	go func() {
+		errs <- pc.forwardRequests()
+	}()
+
+	go func() {
+		errs <- pc.forwardReplies()
+	}()
+
+	err := <-errs
+	pc.close()
+	<-errs
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+func (pc *proxyConn) close() {
+	pc.closeOnce.Do(func() {
+		pc.client.Close()
+		pc.backend.Close()
+	})
+}
+
+// forwardRequests sends the requests from the client to XenStore, replying to those
+// which are not allowed itself.
+func (pc *proxyConn) forwardRequests() error {
+	for {
+		req, err := pc.client.Receive()
+		if err != nil {
+			return err
+		}
+
+		if !pc.proxy.allowed(req) {
+			pc.proxy.cfg.Logger.Debugf("proxy denied request %s", req)
+
+			payload := []byte(ErrorName(ErrPermission) + "\x00")
+			err := pc.reply(&Packet{
+				Header: &PacketHeader{
+					Op:     XsError,
+					RqId:   req.Header.RqId,
+					TxId:   req.Header.TxId,
+					Length: uint32(len(payload)),
+				},
+				Payload: payload,
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := pc.backend.Send(req); err != nil {
+			return err
+		}
+	}
+}
+
+// forwardReplies sends the replies & watch events from XenStore to the client.
+func (pc *proxyConn) forwardReplies() error {
+	for {
+		rsp, err := pc.backend.Receive()
+		if err != nil {
+			return err
+		}
+
+		if err := pc.reply(rsp); err != nil {
+			return err
+		}
+	}
+}
+
+func (pc *proxyConn) reply(p *Packet) error {
+	pc.writeLock.Lock()
+	defer pc.writeLock.Unlock()
+
+	return pc.client.Send(p)
+}
@@ -0,0 +1,298 @@
+package xenstore_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+// startProxy serves a Proxy in front of store on a local TCP port, wrapping the
+// listener in TLS if serverConfig is not nil.
+func startProxy(t *testing.T, store *xenstoretest.MemoryStore, cfg ProxyConfig, serverConfig *tls.Config) (*Proxy, string) {
+	t.Helper()
+
+	cfg.Dial = func() (Transport, error) {
+		return store.Connect(), nil
+	}
+
+	p, err := NewProxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if serverConfig != nil {
+		l = tls.NewListener(l, serverConfig)
+	}
+
+	go p.Serve(l)
+
+	return p, l.Addr().String()
+}
+
+func TestProxy(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	local := store.Client()
+	defer local.Close()
+
+	for p, value := range map[string]string{
+		"/local/domain/1/name":   "guest",
+		"/local/domain/1/secret": "hidden",
+		"/vm/1/name":             "guest",
+	} {
+		if _, err := local.Write(p, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, addr := startProxy(t, store, ProxyConfig{
+		AllowOps:   []string{"read", "directory", "write", "watch", "unwatch", "transaction_start", "transaction_end"},
+		AllowPaths: []string{"/local/domain/*/{name,data/**}", "/vm/**"},
+	}, nil)
+	defer p.Close()
+
+	tr, err := NewTCPTransport(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(tr)
+	defer c.Close()
+
+	value, err := c.Read("/local/domain/1/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "guest", value)
+
+	children, err := c.List("/vm/1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"name"}, children)
+
+	// Denied by path
+	_, err = c.Read("/local/domain/1/secret")
+	assert.True(t, errors.Is(err, ErrPermission))
+
+	_, err = c.Write("/local/domain/1/other", "x")
+	assert.True(t, errors.Is(err, ErrPermission))
+
+	// Denied by operation
+	_, err = c.Remove("/vm/1/name")
+	assert.True(t, errors.Is(err, ErrPermission))
+
+	// Transactions & watches pass straight through
+	assert.NoError(t, c.Transact(func(tx *Transaction) error {
+		_, err := tx.Write("/local/domain/1/data/key", "value")
+		return err
+	}))
+
+	value, err = local.Read("/local/domain/1/data/key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	ch, err := c.Watch("/vm/1", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The initial event
+	assert.Equal(t, "/vm/1", nextEvent(t, ch))
+
+	if _, err := local.Write("/vm/1/name", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/vm/1/name", nextEvent(t, ch))
+
+	assert.NoError(t, c.UnWatch("/vm/1", "token"))
+}
+
+// nextEvent waits for the next watch event on ch, returning its path.
+func nextEvent(t *testing.T, ch chan *Packet) string {
+	t.Helper()
+
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				t.Fatal("watch channel closed")
+			}
+
+			if p.Header.Op == XsWatchEvent {
+				return p.Strings()[0]
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a watch event")
+		}
+	}
+}
+
+func TestProxyBadPattern(t *testing.T) {
+	_, err := NewProxy(ProxyConfig{
+		Dial:       func() (Transport, error) { return nil, nil },
+		AllowPaths: []string{"/local/domain/[1"},
+	})
+	assert.Error(t, err)
+}
+
+func TestProxyBadOperation(t *testing.T) {
+	_, err := NewProxy(ProxyConfig{
+		Dial:     func() (Transport, error) { return nil, nil },
+		AllowOps: []string{"read", "raed"},
+	})
+	assert.Error(t, err)
+}
+
+func TestProxyPathsOnly(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	local := store.Client()
+	defer local.Close()
+
+	if _, err := local.Write("/local/domain/5/name", "guest"); err != nil {
+		t.Fatal(err)
+	}
+
+	p, addr := startProxy(t, store, ProxyConfig{
+		AllowPaths: []string{"/local/domain/5/**"},
+	}, nil)
+	defer p.Close()
+
+	tr, err := NewTCPTransport(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(tr)
+	defer c.Close()
+
+	value, err := c.Read("/local/domain/5/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "guest", value)
+
+	// Operations without a path are not covered by the paths, so have to be allowed
+	// explicitly
+	_, err = c.GetDomainPath(5)
+	assert.True(t, errors.Is(err, ErrPermission))
+
+	err = c.Transact(func(tx *Transaction) error { return nil })
+	assert.True(t, errors.Is(err, ErrPermission))
+}
+
+func TestProxyClose(t *testing.T) {
+	p, addr := startProxy(t, xenstoretest.NewMemoryStore(), ProxyConfig{}, nil)
+
+	tr, err := NewTCPTransport(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(tr)
+	defer c.Close()
+
+	_, err = c.Mkdir("/test")
+	assert.NoError(t, err)
+
+	assert.NoError(t, p.Close())
+
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client was not disconnected")
+	}
+}
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1 which can be used
+// by both ends of a TLS connection.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "xenstore-go test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestProxyMutualTLS(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+
+	store := xenstoretest.NewMemoryStore()
+	p, addr := startProxy(t, store, ProxyConfig{}, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer p.Close()
+
+	tr, err := (&TCPDialer{
+		Timeout: 5 * time.Second,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+		},
+	}).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(tr)
+	defer c.Close()
+
+	_, err = c.Write("/test/value", "secure")
+	assert.NoError(t, err)
+
+	value, err := c.Read("/test/value")
+	assert.NoError(t, err)
+	assert.Equal(t, "secure", value)
+
+	// Clients without a certificate are refused
+	tr, err = NewTCPTransport(addr, &tls.Config{RootCAs: pool})
+	if err == nil {
+		anonymous := NewClient(tr)
+		defer anonymous.Close()
+
+		_, err = anonymous.Read("/test/value")
+	}
+	assert.Error(t, err)
+}
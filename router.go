@@ -1,53 +1,144 @@
 package xenstore
 
 import (
-	"fmt"
+	"errors"
+	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
+// writeQueueSize is the number of packets which can be waiting for the writer
+// goroutine before callers of Router.Send block.
+const writeQueueSize = 256
+
 // NewRouter creates a new instance of the Router struct for Transport t with all
 // of the correct defaults set.
 func NewRouter(t Transport) *Router {
-	return &Router{
-		transport:  t,
-		channelMap: map[uint32]chan *Packet{},
-		watchMap:   map[string][]chan *Packet{},
+	r := &Router{
 		lock:       sync.Mutex{},
-		loop:       true,
+		writeQueue: make(chan *writeRequest, writeQueueSize),
+		done:       make(chan struct{}),
+		logger:     log.StandardLogger(),
 	}
+	r.transport.Store(transportBox{t})
+	r.watchMap.Store(&map[string][]*watchRegistration{})
+	r.loop.Store(true)
+
+	return r
 }
 
 // Router provides a way of sending a Packet and receiving the reply in return.
 // It does ths by intercepting all packets over a Transport and forwarding them
 // to listeners over channels.
+//
+// Packets are written to the Transport by a single writer goroutine fed from a
+// queue, so callers of Send never wait for each other to finish writing, and
+// replies are matched to requests without taking a lock.
 type Router struct {
-	transport  Transport
-	channelMap map[uint32]chan *Packet
-	watchMap   map[string][]chan *Packet
-	lock       sync.Mutex
-	loop       bool
+	transport atomic.Value
+	observer  atomic.Value
+	pending   sync.Map
+
+	// watchMap holds the watches for each token, which XenStore allows to be used on
+	// several paths. It is replaced rather than modified so that it can be read
+	// without locking. lock must be held to replace it.
+	watchMap atomic.Pointer[map[string][]*watchRegistration]
+	lock     sync.Mutex
+
+	writeQueue  chan *writeRequest
+	writerStart sync.Once
+	done        chan struct{}
+	loop        atomic.Bool
+	stopped     atomic.Bool
+
+	watchBufferSize int
+	orphanHandler   func(*Packet)
+	logger          Logger
+	reconnect       *ReconnectPolicy
+}
+
+// transportBox and observerBox allow interface values to be stored in an atomic.Value
+// regardless of their concrete type.
+type transportBox struct{ Transport }
+type observerBox struct{ Observer }
+
+// pendingRequest holds the details of a request which is waiting for a reply.
+type pendingRequest struct {
+	ch   chan *Packet
+	req  *Packet
+	sent time.Time
+}
+
+// writeRequest is a packet waiting to be written by the writer goroutine.
+type writeRequest struct {
+	pkt    *Packet
+	result chan error
+}
+
+// watchRegistration holds the channels listening for events from a single watch,
+// which XenStore identifies by its path & token together.
+type watchRegistration struct {
+	path     string
+	channels []chan *Packet
+}
+
+// SetObserver sets the Observer which will be notified about packets passing
+// through the Router. Passing nil disables notifications.
+func (r *Router) SetObserver(o Observer) {
+	r.observer.Store(observerBox{o})
+}
+
+func (r *Router) currentObserver() Observer {
+	if o, ok := r.observer.Load().(observerBox); ok {
+		return o.Observer
+	}
+
+	return nil
+}
+
+func (r *Router) currentTransport() Transport {
+	return r.transport.Load().(transportBox).Transport
 }
 
-// Start starts the Router's internal event loop.
+// Start starts the Router's internal event loop. When the loop exits any requests
+// still waiting for a reply have their channels closed.
 func (r *Router) Start() error {
-	r.loop = true
+	defer r.shutdown()
 
 OUTER:
-	for r.loop {
-		p, err := r.transport.Receive()
+	for r.loop.Load() {
+		p, err := r.currentTransport().Receive()
 		if err != nil {
-			if !r.loop {
-				// If the error is that the file was already closed then it likely
-				// means that we closed it so swallow this specific error.
-				switch v := err.(type) {
-				case *os.PathError:
-					if v.Err == os.ErrClosed {
-						break OUTER
+			if !r.loop.Load() && (errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed)) {
+				// The Transport was closed by Stop, whether it is a file or a socket,
+				// so this is a clean shutdown rather than a failure.
+				break OUTER
+			}
+
+			var framingErr *FramingError
+			if errors.As(err, &framingErr) {
+				// There is no way to find the start of the next packet so the
+				// connection has to be dropped.
+				r.logger.Warnf("closing connection to XenStore: %s", err)
+
+				if r.reconnect == nil {
+					if cerr := r.currentTransport().Close(); cerr != nil {
+						r.logger.Debugf("error closing transport: %s", cerr)
 					}
 				}
 			}
 
+			if r.reconnect != nil && r.loop.Load() {
+				if rerr := r.reconnectTransport(err); rerr == nil {
+					continue
+				}
+			}
+
 			return err
 		}
 
@@ -58,65 +149,425 @@ OUTER:
 }
 
 // Send sends a Packet to XenStore and returns a channel which the response Packet
-// will be sent over when it is received.
+// will be sent over when it is received. The channel is closed without a reply if
+// the Router stops or loses its connection first.
+//
+// Send is safe to call from multiple goroutines and only waits for its own packet
+// to be written, so many requests can be in flight at once.
 func (r *Router) Send(pkt *Packet) (chan *Packet, error) {
-	c := make(chan *Packet)
+	if r.stopped.Load() {
+		return nil, ErrRouterStopped
+	}
 
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	// Replies are buffered so that the event loop never blocks on a caller which
+	// has given up waiting.
+	c := make(chan *Packet, 1)
+	if pkt.Header.Op == XsWatch {
+		c = make(chan *Packet, r.watchBufferSize)
+
+		// Register before writing so that no event can arrive before the channel
+		// is known about.
+		payloadParts := pkt.Strings()
+		if err := r.addWatchChannel(payloadParts[0], payloadParts[1], c); err != nil {
+			return nil, err
+		}
+	}
 
-	r.channelMap[pkt.Header.RqId] = c
+	r.pending.Store(pkt.Header.RqId, &pendingRequest{
+		ch:   c,
+		req:  pkt,
+		sent: time.Now(),
+	})
+	r.requestSent(pkt)
 
-	if err := r.transport.Send(pkt); err != nil {
-		delete(r.channelMap, pkt.Header.RqId)
-		return nil, err
+	err := r.write(pkt, true)
+	if err == nil && r.stopped.Load() {
+		// The Router stopped while writing & may have missed this request when
+		// cleaning up, in which case nobody would ever close the channel.
+		if _, ok := r.pending.Load(pkt.Header.RqId); ok {
+			err = ErrRouterStopped
+		}
 	}
 
-	if pkt.Header.Op == XsWatch {
-		payloadParts := pkt.Strings()
+	if err != nil {
+		r.cancel(pkt.Header.RqId)
 
-		if _, ok := r.watchMap[payloadParts[1]]; !ok {
-			r.watchMap[payloadParts[1]] = []chan *Packet{}
+		if pkt.Header.Op == XsWatch {
+			payloadParts := pkt.Strings()
+			r.removeChannel(payloadParts[0], payloadParts[1], c)
 		}
 
-		r.watchMap[payloadParts[1]] = append(r.watchMap[payloadParts[1]], c)
+		return nil, err
 	}
+
 	return c, nil
 }
 
+// write queues a packet for the writer goroutine and, if wait is true, waits for it
+// to be written.
+func (r *Router) write(pkt *Packet, wait bool) error {
+	r.writerStart.Do(func() {
+		go r.writer()
+	})
+
+	w := &writeRequest{pkt: pkt, result: make(chan error, 1)}
+
+	select {
+	case r.writeQueue <- w:
+	case <-r.done:
+		return ErrRouterStopped
+	}
+
+	if !wait {
+		return nil
+	}
+
+	select {
+	case err := <-w.result:
+		return err
+	case <-r.done:
+		return ErrRouterStopped
+	}
+}
+
+// writer writes queued packets to the Transport one at a time until the Router
+// stops.
+func (r *Router) writer() {
+	for {
+		select {
+		case w := <-r.writeQueue:
+			w.result <- r.currentTransport().Send(w.pkt)
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// requestSent notifies the Observer about a request. This happens before the request
+// is given to the writer goroutine, as the reply may be received as soon as it has
+// been written.
+func (r *Router) requestSent(pkt *Packet) {
+	if o := r.currentObserver(); o != nil {
+		o.RequestSent(pkt)
+	}
+}
+
+// cancel forgets about a request so that any reply which arrives later is treated
+// as an orphan, telling the Observer that it was abandoned unless the reply or
+// failPending got to it first.
+func (r *Router) cancel(rqid uint32) {
+	value, ok := r.pending.LoadAndDelete(rqid)
+	if !ok {
+		return
+	}
+
+	if o := r.currentObserver(); o != nil {
+		pending := value.(*pendingRequest)
+		o.ResponseReceived(pending.req, nil, time.Since(pending.sent))
+	}
+}
+
 // Stop ends the internal event loop as soon as the next packet has been received
 func (r *Router) Stop() {
-	r.loop = false
+	r.loop.Store(false)
+}
+
+// watches returns the current set of watches, keyed by token. The returned map must
+// not be modified.
+func (r *Router) watches() map[string][]*watchRegistration {
+	return *r.watchMap.Load()
+}
+
+// updateWatches replaces the registrations for token with those returned by update,
+// which is passed the current registrations & must not modify them. The caller must
+// hold r.lock.
+func (r *Router) updateWatches(token string, update func([]*watchRegistration) []*watchRegistration) {
+	current := r.watches()
+
+	watches := make(map[string][]*watchRegistration, len(current)+1)
+	for t, registrations := range current {
+		watches[t] = registrations
+	}
+
+	if registrations := update(current[token]); len(registrations) > 0 {
+		watches[token] = registrations
+	} else {
+		delete(watches, token)
+	}
+
+	r.watchMap.Store(&watches)
 }
 
-func (r *Router) removeWatchChannel(token string) {
+func (r *Router) addWatchChannel(path, token string, c chan *Packet) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	delete(r.watchMap, token)
+
+	if r.stopped.Load() {
+		return ErrRouterStopped
+	}
+
+	r.updateWatches(token, func(current []*watchRegistration) []*watchRegistration {
+		var registrations []*watchRegistration
+		channels := []chan *Packet{c}
+
+		for _, watch := range current {
+			if watch.path == path {
+				channels = append(append([]chan *Packet{}, watch.channels...), c)
+			} else {
+				registrations = append(registrations, watch)
+			}
+		}
+
+		return append(registrations, &watchRegistration{path: path, channels: channels})
+	})
+
+	return nil
 }
 
-func (r *Router) sendToChannel(pkt *Packet) {
+// removeChannel stops a single channel receiving events for the watch on path with
+// token.
+func (r *Router) removeChannel(path, token string, c chan *Packet) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
+	r.updateWatches(token, func(current []*watchRegistration) []*watchRegistration {
+		var registrations []*watchRegistration
+
+		for _, watch := range current {
+			if watch.path != path {
+				registrations = append(registrations, watch)
+				continue
+			}
+
+			var channels []chan *Packet
+			for _, ch := range watch.channels {
+				if ch != c {
+					channels = append(channels, ch)
+				}
+			}
+
+			if len(channels) > 0 {
+				registrations = append(registrations, &watchRegistration{path: path, channels: channels})
+			}
+		}
+
+		return registrations
+	})
+}
+
+// removeWatchChannel stops delivering events for the watch on path with token &
+// closes its channels, ending any range loops over them. This runs on the event loop
+// goroutine, which is the only sender on the channels.
+func (r *Router) removeWatchChannel(path, token string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var removed *watchRegistration
+
+	r.updateWatches(token, func(current []*watchRegistration) []*watchRegistration {
+		var registrations []*watchRegistration
+
+		for _, watch := range current {
+			if watch.path == path {
+				removed = watch
+			} else {
+				registrations = append(registrations, watch)
+			}
+		}
+
+		return registrations
+	})
+
+	if removed != nil {
+		for _, ch := range removed.channels {
+			close(ch)
+		}
+	}
+}
+
+// shutdown stops any further requests being sent and closes the channels of all of
+// the requests which are still waiting for a reply and of all watches.
+func (r *Router) shutdown() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.stopped.Store(true)
+	close(r.done)
+
+	r.failPending(true)
+
+	for _, registrations := range r.watches() {
+		for _, watch := range registrations {
+			for _, ch := range watch.channels {
+				close(ch)
+			}
+		}
+	}
+	r.watchMap.Store(&map[string][]*watchRegistration{})
+}
+
+// failPending closes the channels of requests which are waiting for a reply. If
+// keepWatches is true then channels which also receive watch events are left open.
+func (r *Router) failPending(keepWatches bool) {
+	r.pending.Range(func(key, value interface{}) bool {
+		if _, ok := r.pending.LoadAndDelete(key); !ok {
+			return true
+		}
+
+		pending := value.(*pendingRequest)
+
+		if o := r.currentObserver(); o != nil {
+			o.ResponseReceived(pending.req, nil, time.Since(pending.sent))
+		}
+
+		if !keepWatches || pending.req.Header.Op != XsWatch {
+			close(pending.ch)
+		}
+
+		return true
+	})
+}
+
+// reconnectTransport replaces the current Transport following the receive error
+// cause, using the configured ReconnectPolicy.
+func (r *Router) reconnectTransport(cause error) error {
+	old := r.currentTransport()
+	r.failPending(true)
+
+	r.logger.Warnf("lost connection to XenStore, reconnecting: %s", cause)
+
+	if err := old.Close(); err != nil {
+		r.logger.Debugf("error closing old transport: %s", err)
+	}
+
+	backoff := r.reconnect.Backoff
+	for attempt := 1; r.reconnect.MaxAttempts == 0 || attempt <= r.reconnect.MaxAttempts; attempt++ {
+		time.Sleep(backoff)
+
+		if !r.loop.Load() {
+			return ErrRouterStopped
+		}
+
+		t, err := r.reconnect.Dial()
+		if err == nil {
+			return r.replaceTransport(t)
+		}
+
+		r.logger.Warnf("reconnect attempt %d failed: %s", attempt, err)
+
+		backoff *= 2
+		if r.reconnect.MaxBackoff > 0 && backoff > r.reconnect.MaxBackoff {
+			backoff = r.reconnect.MaxBackoff
+		}
+	}
+
+	return cause
+}
+
+// replaceTransport switches the Router over to a newly connected Transport and
+// registers all of the current watches again.
+func (r *Router) replaceTransport(t Transport) error {
+	r.transport.Store(transportBox{t})
+
+	for token, registrations := range r.watches() {
+		for _, watch := range registrations {
+			p, err := NewPacket(XsWatch, []byte(watch.path+"\x00"+token+"\x00"), 0x0)
+			if err != nil {
+				return err
+			}
+
+			// Nobody is waiting for the acknowledgement so give it somewhere to go.
+			r.pending.Store(p.Header.RqId, &pendingRequest{
+				ch:   make(chan *Packet, 1),
+				req:  p,
+				sent: time.Now(),
+			})
+			r.requestSent(p)
+
+			// This runs on the event loop goroutine, which has to keep running to
+			// receive the replies, so don't wait for the writes to finish.
+			if err := r.write(p, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Router) orphan(pkt *Packet) {
+	if r.orphanHandler != nil {
+		r.orphanHandler(pkt)
+		return
+	}
+
+	r.logger.Warnf("dropping packet with no listener: %s", pkt)
+}
+
+func (r *Router) sendToChannel(pkt *Packet) {
 	if pkt.Header.Op == XsWatchEvent {
 		payloadParts := pkt.Strings()
 		watchToken := payloadParts[1]
 
-		if channels, ok := r.watchMap[watchToken]; ok {
-			for _, chnl := range channels {
-				chnl <- pkt
+		if o := r.currentObserver(); o != nil {
+			o.WatchEvent(pkt)
+		}
+
+		if watches := matchWatches(r.watches()[watchToken], payloadParts[0]); len(watches) > 0 {
+			for _, watch := range watches {
+				for _, chnl := range watch.channels {
+					chnl <- pkt
+				}
 			}
 		} else {
-			panic(fmt.Sprintf("no channel(s) to send packet for '%s' to!", watchToken))
+			r.orphan(pkt)
 		}
 	} else {
-		if chnl, ok := r.channelMap[pkt.Header.RqId]; ok {
-			chnl <- pkt
+		if value, ok := r.pending.LoadAndDelete(pkt.Header.RqId); ok {
+			pending := value.(*pendingRequest)
+
+			if o := r.currentObserver(); o != nil {
+				o.ResponseReceived(pending.req, pkt, time.Since(pending.sent))
+			}
+
+			// Stop delivering events as soon as the watch has been removed, so that none
+			// are sent to a channel whose reader has stopped after UnWatch returned
+			if pending.req.Header.Op == XsUnWatch && pkt.Header.Op != XsError {
+				payloadParts := pending.req.Strings()
+				r.removeWatchChannel(payloadParts[0], payloadParts[1])
+			}
+
+			pending.ch <- pkt
 		} else {
-			panic(fmt.Sprintf("no channel to send packet for %d to!", pkt.Header.RqId))
+			r.orphan(pkt)
 		}
+	}
+}
+
+// matchWatches returns the registrations of the watches which fire for a change to
+// path. Events carry only the token & the changed path, so when a token is used on
+// nested paths both watches are given every event below the inner one.
+func matchWatches(registrations []*watchRegistration, path string) []*watchRegistration {
+	// A token used on a single path needs no matching
+	if len(registrations) == 1 {
+		return registrations
+	}
+
+	var matched []*watchRegistration
+	for _, watch := range registrations {
+		if watchCovers(watch.path, path) {
+			matched = append(matched, watch)
+		}
+	}
 
-		delete(r.channelMap, pkt.Header.RqId)
+	return matched
+}
+
+// watchCovers reports whether a watch on watchPath fires for a change to path.
+func watchCovers(watchPath, path string) bool {
+	if path == watchPath || watchPath == "/" && strings.HasPrefix(path, "/") {
+		return true
 	}
+
+	return strings.HasPrefix(path, watchPath+"/")
 }
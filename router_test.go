@@ -1,21 +1,30 @@
-package xenstore
+package xenstore_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
 )
 
 type BufferTransport struct {
 	*ReadWriteTransport
+	buf *bytes.Buffer
 }
 
 func NewBufferTransport() *BufferTransport {
 	var buf = bytes.NewBuffer([]byte{})
 
 	return &BufferTransport{
-		&ReadWriteTransport{
-			rw:   BufCloser{buf},
-			open: true,
-		},
+		NewReadWriteTransport(BufCloser{buf}),
+		buf,
 	}
 }
 
@@ -26,3 +35,198 @@ type BufCloser struct {
 func (b BufCloser) Close() error {
 	return nil
 }
+
+func TestRouterConcurrentRequests(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			path := fmt.Sprintf("/test/%d", i)
+			for j := 0; j < 20; j++ {
+				value := fmt.Sprintf("%d-%d", i, j)
+
+				if _, err := c.Write(path, value); err != nil {
+					errs <- err
+					return
+				}
+
+				got, err := c.Read(path)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if got != value {
+					errs <- fmt.Errorf("read %s: got %q, expected %q", path, got, value)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func benchmarkConcurrent(b *testing.B, goroutines int, op func(c *Client, path string) error) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	for i := 0; i < goroutines; i++ {
+		if _, err := c.Write(fmt.Sprintf("/bench/%d", i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var remaining = int64(b.N)
+	var wg sync.WaitGroup
+
+	b.ResetTimer()
+
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+
+			for atomic.AddInt64(&remaining, -1) >= 0 {
+				if err := op(c, path); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(fmt.Sprintf("/bench/%d", i))
+	}
+
+	wg.Wait()
+}
+
+func BenchmarkRouterRead(b *testing.B) {
+	for _, n := range []int{1, 8, 64, 256} {
+		b.Run(fmt.Sprintf("goroutines=%d", n), func(b *testing.B) {
+			benchmarkConcurrent(b, n, func(c *Client, path string) error {
+				_, err := c.Read(path)
+				return err
+			})
+		})
+	}
+}
+
+func BenchmarkRouterWrite(b *testing.B) {
+	for _, n := range []int{1, 8, 64, 256} {
+		b.Run(fmt.Sprintf("goroutines=%d", n), func(b *testing.B) {
+			benchmarkConcurrent(b, n, func(c *Client, path string) error {
+				_, err := c.Write(path, "value")
+				return err
+			})
+		})
+	}
+}
+
+func TestRouterClosesOnFramingError(t *testing.T) {
+	tr := NewBufferTransport()
+	(&PacketHeader{Op: XsRead, Length: 1 << 30}).Pack(tr.buf)
+
+	c := NewClient(tr)
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("router did not stop")
+	}
+
+	assert.True(t, errors.Is(c.Error(), ErrPayloadTooLarge))
+	assert.False(t, tr.IsOpen())
+}
+
+func TestRouterUnWatchClosesChannel(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	ch, err := c.Watch("/local/domain/1", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for rsp := range ch {
+			if rsp.Header.Op == XsWatchEvent {
+				events <- rsp.Strings()[0]
+			}
+		}
+	}()
+
+	assert.Equal(t, "/local/domain/1", <-events)
+	assert.NoError(t, c.UnWatch("/local/domain/1", "tok"))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("range over the watch channel did not end after UnWatch")
+	}
+
+	// Closing the Client must not close the channel a second time
+	assert.NoError(t, c.Close())
+}
+
+func TestRouterWatchSameTokenTwoPaths(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	// Events are written by another client so that they can be read after each write
+	writer := store.Client()
+	defer writer.Close()
+
+	c := store.Client()
+	defer c.Close()
+
+	for _, p := range []string{"/local/domain/1/name", "/local/domain/2/name"} {
+		if _, err := writer.Write(p, "guest"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ch1, err := c.Watch("/local/domain/1", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/local/domain/1", nextEvent(t, ch1))
+
+	ch2, err := c.Watch("/local/domain/2", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/local/domain/2", nextEvent(t, ch2))
+
+	// Each watch only receives the events for its own path
+	_, err = writer.Write("/local/domain/2/name", "renamed")
+	assert.NoError(t, err)
+	assert.Equal(t, "/local/domain/2/name", nextEvent(t, ch2))
+
+	_, err = writer.Write("/local/domain/1/name", "renamed")
+	assert.NoError(t, err)
+	assert.Equal(t, "/local/domain/1/name", nextEvent(t, ch1))
+
+	// Removing one watch leaves the other working
+	assert.NoError(t, c.UnWatch("/local/domain/1", "tok"))
+	for range ch1 {
+	}
+
+	_, err = writer.Write("/local/domain/2/name", "again")
+	assert.NoError(t, err)
+	assert.Equal(t, "/local/domain/2/name", nextEvent(t, ch2))
+	assert.Equal(t, 1, c.WatchCount())
+}
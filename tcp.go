@@ -0,0 +1,64 @@
+package xenstore
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// TCPTransport is an implementation of Transport which sends/receives data over a TCP
+// connection, optionally secured with TLS, such as one made to a Proxy on another
+// host. The Packets are sent exactly as they would be over a unix socket.
+type TCPTransport struct {
+	*ReadWriteTransport
+
+	Addr string
+}
+
+// NewTCPTransport creates a new TCPTransport connected to addr, using TLS if
+// tlsConfig is not nil.
+func NewTCPTransport(addr string, tlsConfig *tls.Config) (*TCPTransport, error) {
+	return (&TCPDialer{TLSConfig: tlsConfig}).Dial(addr)
+}
+
+// TCPDialer holds the options for connecting to XenStore over TCP. The zero value
+// connects without TLS or a timeout.
+type TCPDialer struct {
+	// Timeout is the maximum time to wait for the connection to be made, including the
+	// TLS handshake. Zero means no timeout.
+	Timeout time.Duration
+	// TLSConfig enables TLS when not nil. Setting Certificates in it provides a client
+	// certificate for servers which require mutual TLS.
+	TLSConfig *tls.Config
+}
+
+// Dial connects to addr, which is in the form "host:port".
+func (d *TCPDialer) Dial(addr string) (*TCPTransport, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext is Dial but gives up if ctx is done before the connection is made.
+func (d *TCPDialer) DialContext(ctx context.Context, addr string) (*TCPTransport, error) {
+	var c net.Conn
+	var err error
+
+	if d.TLSConfig != nil {
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: d.Timeout},
+			Config:    d.TLSConfig,
+		}
+		c, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		dialer := &net.Dialer{Timeout: d.Timeout}
+		c, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &TCPTransport{
+		ReadWriteTransport: NewReadWriteTransport(c),
+		Addr:               addr,
+	}, nil
+}
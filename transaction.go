@@ -0,0 +1,135 @@
+package xenstore
+
+import (
+	"errors"
+	"strconv"
+)
+
+// maxTransactionAttempts is the number of times Client.Transact will run a
+// transaction which keeps conflicting with other changes before giving up.
+const maxTransactionAttempts = 16
+
+// Transaction is a set of operations which XenStore applies atomically when the
+// Transaction is committed. Reads within a Transaction all see the same consistent
+// view of the store. Committing fails with ErrTransactionConflict if anything read
+// or written has been changed by somebody else in the meantime, in which case the
+// whole Transaction should be retried.
+type Transaction struct {
+	client *Client
+	id     uint32
+}
+
+// StartTransaction starts a new Transaction. Either Commit or Abort must be called
+// once the Transaction is finished with.
+func (c *Client) StartTransaction() (*Transaction, error) {
+	p, err := c.submitBytes(XsStartTransaction, []byte{NUL}, 0x0)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseUint(p.payloadString(), 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transaction{client: c, id: uint32(id)}, nil
+}
+
+// Transact runs fn within a new Transaction, which is committed if fn returns nil and
+// aborted otherwise. If committing fails because of a conflicting change then the
+// Transaction is retried from the start, so fn may be called several times and
+// should not have side effects outside of the Transaction.
+func (c *Client) Transact(fn func(*Transaction) error) error {
+	var err error
+
+	for attempt := 0; attempt < maxTransactionAttempts; attempt++ {
+		var tx *Transaction
+		if tx, err = c.StartTransaction(); err != nil {
+			return err
+		}
+
+		if err = fn(tx); err != nil {
+			if abortErr := tx.Abort(); abortErr != nil {
+				return abortErr
+			}
+
+			if !errors.Is(err, ErrTransactionConflict) {
+				return err
+			}
+
+			continue
+		}
+
+		if err = tx.Commit(); !errors.Is(err, ErrTransactionConflict) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// ID returns the transaction ID assigned by XenStore.
+func (t *Transaction) ID() uint32 {
+	return t.id
+}
+
+// Commit ends the Transaction, applying all of the changes made within it.
+func (t *Transaction) Commit() error {
+	return t.end(true)
+}
+
+// Abort ends the Transaction, discarding all of the changes made within it.
+func (t *Transaction) Abort() error {
+	return t.end(false)
+}
+
+func (t *Transaction) end(commit bool) error {
+	payload := []byte{'F', NUL}
+	if commit {
+		payload[0] = 'T'
+	}
+
+	_, err := t.client.submitBytes(XsEndTransaction, payload, t.id)
+	return err
+}
+
+// List lists the descendants of path within the Transaction.
+func (t *Transaction) List(path string) ([]string, error) {
+	return t.client.list(path, t.id)
+}
+
+// Read reads the contents of path within the Transaction.
+func (t *Transaction) Read(path string) (string, error) {
+	return t.client.read(path, t.id)
+}
+
+// ReadMany reads the contents of all of paths within the Transaction, sending all of
+// the requests before waiting for any replies. See Client.ReadMany.
+func (t *Transaction) ReadMany(paths []string) (map[string]string, map[string]error) {
+	return t.client.readMany(paths, t.id)
+}
+
+// Remove removes a path recursively within the Transaction.
+func (t *Transaction) Remove(path string) (string, error) {
+	return t.client.remove(path, t.id)
+}
+
+// Write writes value to path within the Transaction.
+func (t *Transaction) Write(path, value string) (string, error) {
+	return t.client.write(path, value, t.id)
+}
+
+// GetPermissions returns the permissions for path within the Transaction.
+func (t *Transaction) GetPermissions(path string) (string, error) {
+	return t.client.getPermissions(path, t.id)
+}
+
+// SetPermissions sets the permissions for path within the Transaction.
+func (t *Transaction) SetPermissions(path string, perms []string) (string, error) {
+	return t.client.setPermissions(path, perms, t.id)
+}
+
+// Mkdir creates path and any missing parents within the Transaction.
+func (t *Transaction) Mkdir(path string) (string, error) {
+	return t.client.mkdir(path, t.id)
+}
@@ -0,0 +1,91 @@
+package xenstore_test
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionCommitAbort(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	tx, err := c.StartTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tx.Write("/test/committed", "yes"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not visible outside the transaction until it is committed
+	_, err = c.Read("/test/committed")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := c.Read("/test/committed")
+	assert.Nil(t, err)
+	assert.Equal(t, "yes", val)
+
+	tx, err = c.StartTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tx.Write("/test/aborted", "yes"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Read("/test/aborted")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestTransactRetriesConflicts(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+
+	c, other := store.Client(), store.Client()
+	defer c.Close()
+	defer other.Close()
+
+	if _, err := c.Write("/test/counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	err := c.Transact(func(tx *Transaction) error {
+		attempts++
+
+		val, err := tx.Read("/test/counter")
+		if err != nil {
+			return err
+		}
+
+		if attempts == 1 {
+			// Change the value underneath the transaction so that it conflicts
+			if _, err := other.Write("/test/counter", "5"); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Write("/test/counter", val+"1")
+		return err
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	val, err := c.Read("/test/counter")
+	assert.Nil(t, err)
+	assert.Equal(t, "51", val)
+}
@@ -1,9 +1,13 @@
 package xenstore
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
 // Transport is an interface for sending and receiving data from XenStore.
@@ -20,12 +24,20 @@ type Transport interface {
 // io.ReadWriteCloser..
 type ReadWriteTransport struct {
 	rw   io.ReadWriteCloser
-	open bool
+	open atomic.Bool
+}
+
+// NewReadWriteTransport creates a ReadWriteTransport using rw, which is closed when
+// the Transport is.
+func NewReadWriteTransport(rw io.ReadWriteCloser) *ReadWriteTransport {
+	t := &ReadWriteTransport{rw: rw}
+	t.open.Store(true)
+
+	return t
 }
 
 func (r *ReadWriteTransport) Close() error {
-	if r.open {
-		r.open = false
+	if r.open.CompareAndSwap(true, false) {
 		return r.rw.Close()
 	}
 
@@ -33,26 +45,42 @@ func (r *ReadWriteTransport) Close() error {
 	return nil
 }
 
+// Send writes p to the underlying io.ReadWriteCloser. It fails with an error wrapping
+// net.ErrClosed if the Transport has been closed.
 func (r *ReadWriteTransport) Send(p *Packet) error {
-	if !r.open {
-		panic("Send on closed transport")
+	if !r.open.Load() {
+		return fmt.Errorf("send on closed transport: %w", net.ErrClosed)
 	}
 
 	return p.Pack(r.rw)
 }
 
+// Receive reads a Packet from the underlying io.ReadWriteCloser. It fails with an
+// error wrapping net.ErrClosed if the Transport has been closed, which may happen
+// from another goroutine while Receive is waiting.
 func (r *ReadWriteTransport) Receive() (*Packet, error) {
-	if !r.open {
-		panic("Receive on closed transport")
+	if !r.open.Load() {
+		return nil, fmt.Errorf("receive on closed transport: %w", net.ErrClosed)
 	}
 
-	p := &Packet{}
-	return p, p.Unpack(r.rw)
+	// The Packet & its header are allocated together, leaving the payload as the only
+	// other allocation. The payload cannot come from a pool as it is owned by the
+	// caller once the Packet is returned.
+	rp := &receivedPacket{}
+	rp.Header = &rp.header
+
+	return &rp.Packet, rp.Unpack(r.rw)
+}
+
+// receivedPacket holds a Packet along with the storage for its header.
+type receivedPacket struct {
+	Packet
+	header PacketHeader
 }
 
 // Check if the underlying io.ReadWriteCloser has been closed yet.
 func (r *ReadWriteTransport) IsOpen() bool {
-	return r.open
+	return r.open.Load()
 }
 
 // UnixSocketTransport is an implementation of Transport which sends/receives data from
@@ -61,22 +89,74 @@ type UnixSocketTransport struct {
 	*ReadWriteTransport
 
 	Path string
+
+	conn *net.UnixConn
 }
 
 // NewUnixSocketTransport creates a new connected UnixSocketTransport.
 func NewUnixSocketTransport(path string) (*UnixSocketTransport, error) {
-	c, err := net.Dial("unix", path)
+	return (&UnixSocketDialer{}).Dial(path)
+}
+
+// NewUnixConnTransport creates a UnixSocketTransport using an existing connection,
+// such as one accepted by a server listening on a unix socket.
+func NewUnixConnTransport(conn *net.UnixConn) *UnixSocketTransport {
+	return &UnixSocketTransport{
+		ReadWriteTransport: NewReadWriteTransport(conn),
+		Path:               conn.LocalAddr().String(),
+		conn:               conn,
+	}
+}
+
+// PeerCredentials returns the credentials of the process at the other end of the
+// socket. See UnixPeerCredentials.
+func (t *UnixSocketTransport) PeerCredentials() (*PeerCredentials, error) {
+	return UnixPeerCredentials(t.conn)
+}
+
+// UnixSocketDialer holds the options for connecting to XenStore using a unix socket.
+// The zero value is ready to use.
+type UnixSocketDialer struct {
+	// Timeout is the maximum time to wait for the connection to be made. Zero means no
+	// timeout.
+	Timeout time.Duration
+}
+
+// Dial connects to the unix socket at path, which may be the read-only socket given
+// by ReadOnlyUnixSocketPath. A path starting with "@" refers to a socket in the Linux
+// abstract namespace.
+func (d *UnixSocketDialer) Dial(path string) (*UnixSocketTransport, error) {
+	return d.DialContext(context.Background(), path)
+}
+
+// DialContext is Dial but gives up if ctx is done before the connection is made.
+func (d *UnixSocketDialer) DialContext(ctx context.Context, path string) (*UnixSocketTransport, error) {
+	dialer := net.Dialer{Timeout: d.Timeout}
+
+	c, err := dialer.DialContext(ctx, "unix", path)
 	if err != nil {
 		return nil, err
 	}
 
-	return &UnixSocketTransport{
-		&ReadWriteTransport{
-			rw:   c,
-			open: true,
-		},
-		path,
-	}, nil
+	t := NewUnixConnTransport(c.(*net.UnixConn))
+	t.Path = path
+
+	return t, nil
+}
+
+// PeerCredentials identifies the process at the other end of a unix socket.
+type PeerCredentials struct {
+	PID int
+	UID int
+	GID int
+}
+
+// UnixPeerCredentials returns the credentials of the process at the other end of
+// conn, as recorded by the kernel when the connection was made (SO_PEERCRED). This
+// lets a server check who it is talking to. ErrNotSupported is returned on systems
+// other than Linux.
+func UnixPeerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
+	return unixPeerCredentials(conn)
 }
 
 // XenBusTransport is an implementation of Transport which sends/receives data from
@@ -96,10 +176,7 @@ func NewXenBusTransport(path string) (*XenBusTransport, error) {
 	}
 
 	return &XenBusTransport{
-		&ReadWriteTransport{
-			rw:   file,
-			open: true,
-		},
+		NewReadWriteTransport(file),
 		path,
 	}, nil
 }
@@ -1 +1,164 @@
-package xenstore
+package xenstore_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/joelnb/xenstore-go"
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveUnixSocket accepts a single connection on l & replies to every request with
+// the same payload.
+func serveUnixSocket(t *testing.T, l *net.UnixListener) chan *UnixSocketTransport {
+	t.Helper()
+
+	accepted := make(chan *UnixSocketTransport, 1)
+	go func() {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			close(accepted)
+			return
+		}
+
+		server := NewUnixConnTransport(conn)
+		accepted <- server
+
+		for {
+			p, err := server.Receive()
+			if err != nil {
+				return
+			}
+
+			if err := server.Send(p); err != nil {
+				return
+			}
+		}
+	}()
+
+	return accepted
+}
+
+func testUnixSocketRoundTrip(t *testing.T, path string) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := serveUnixSocket(t, l)
+
+	tr, err := (&UnixSocketDialer{Timeout: 5 * time.Second}).Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	assert.Equal(t, path, tr.Path)
+
+	server := <-accepted
+	defer server.Close()
+
+	req, err := NewPacket(XsRead, []byte("/local/domain/0/name\x00"), 0x0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, tr.Send(req))
+
+	rsp, err := tr.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, req.Payload, rsp.Payload)
+
+	if runtime.GOOS != "linux" {
+		_, err := server.PeerCredentials()
+		assert.True(t, errors.Is(err, ErrNotSupported))
+		return
+	}
+
+	cred, err := server.PeerCredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, &PeerCredentials{PID: os.Getpid(), UID: os.Getuid(), GID: os.Getgid()}, cred)
+}
+
+func TestUnixSocketTransport(t *testing.T) {
+	testUnixSocketRoundTrip(t, filepath.Join(t.TempDir(), "socket"))
+}
+
+func TestUnixSocketTransportAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are only supported on Linux")
+	}
+
+	testUnixSocketRoundTrip(t, fmt.Sprintf("@xenstore-go-test-%d", os.Getpid()))
+}
+
+func TestUnixSocketTransportMissing(t *testing.T) {
+	_, err := NewUnixSocketTransport(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+// checkCleanClose reads using c & checks that closing it is not reported as an error.
+func checkCleanClose(t *testing.T, c *Client) {
+	t.Helper()
+
+	_, err := c.Read("/local/domain/0/name")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Close())
+
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("router did not stop")
+	}
+
+	assert.NoError(t, c.Error())
+}
+
+func TestClientCloseUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socket")
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := serveUnixSocket(t, l)
+
+	tr, err := NewUnixSocketTransport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(tr)
+	server := <-accepted
+	defer server.Close()
+
+	checkCleanClose(t, c)
+}
+
+func TestClientCloseTCP(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+	if _, err := store.Client().Write("/local/domain/0/name", "Domain-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	p, addr := startProxy(t, store, ProxyConfig{}, nil)
+	defer p.Close()
+
+	tr, err := NewTCPTransport(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkCleanClose(t, NewClient(tr))
+}
@@ -1,14 +1,16 @@
 package xenstore
 
 import (
+	"fmt"
 	"os"
 	"sync"
 )
 
-type xenStoreOperation uint32
+// Operation is the type of the Op field of a PacketHeader, such as XsRead.
+type Operation uint32
 
 const (
-	XsDebug xenStoreOperation = iota
+	XsDebug Operation = iota
 	XsDirectory
 	XsRead
 	XsGetPermissions
@@ -31,7 +33,7 @@ const (
 	XsRestrict
 	XsResetWatches
 
-	XsInvalid xenStoreOperation = 0xffff
+	XsInvalid Operation = 0xffff
 
 	// XenStorePathSeparator is the separator between paths in XenStore. Parts of any path sent
 	// to/received from XenStore should be joined with exactly 1 instance of this string. This is
@@ -40,6 +42,32 @@ const (
 )
 
 var (
+	operationNames = map[Operation]string{
+		XsDebug:              "debug",
+		XsDirectory:          "directory",
+		XsRead:               "read",
+		XsGetPermissions:     "get_perms",
+		XsWatch:              "watch",
+		XsUnWatch:            "unwatch",
+		XsStartTransaction:   "transaction_start",
+		XsEndTransaction:     "transaction_end",
+		XsIntroduce:          "introduce",
+		XsRelease:            "release",
+		XsGetDomainPath:      "get_domain_path",
+		XsWrite:              "write",
+		XsMkdir:              "mkdir",
+		XsRm:                 "rm",
+		XsSetPermissions:     "set_perms",
+		XsWatchEvent:         "watch_event",
+		XsError:              "error",
+		XsIsDomainIntroduced: "is_domain_introduced",
+		XsResume:             "resume",
+		XsSetTarget:          "set_target",
+		XsRestrict:           "restrict",
+		XsResetWatches:       "reset_watches",
+		XsInvalid:            "invalid",
+	}
+
 	requestCounter uint32 = 0x0
 	counterMutex   *sync.Mutex
 
@@ -51,6 +79,28 @@ func init() {
 	counterMutex = &sync.Mutex{}
 }
 
+// String returns the name of the operation as used by the XenStore protocol
+// documentation, e.g. "read" or "get_domain_path".
+func (op Operation) String() string {
+	if name, ok := operationNames[op]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint32(op))
+}
+
+// ParseOperation returns the operation with the given name, as returned by its String
+// method, e.g. "read" or "get_domain_path".
+func ParseOperation(name string) (Operation, error) {
+	for op, opName := range operationNames {
+		if opName == name {
+			return op, nil
+		}
+	}
+
+	return XsInvalid, fmt.Errorf("unknown operation %q", name)
+}
+
 // Event implements a XenStore event
 type Event struct {
 	Path  string
@@ -18,3 +18,14 @@ func TestRequestID(t *testing.T) {
 	assert.Equal(t, maxUint32, RequestID())
 	assert.Equal(t, uint32(0), RequestID())
 }
+
+func TestParseOperation(t *testing.T) {
+	for op := range operationNames {
+		parsed, err := ParseOperation(op.String())
+		assert.NoError(t, err)
+		assert.Equal(t, op, parsed)
+	}
+
+	_, err := ParseOperation("nonsense")
+	assert.Error(t, err)
+}
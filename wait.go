@@ -0,0 +1,135 @@
+package xenstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// watchTokenCounter makes the tokens returned by newWatchToken unique within the
+// process.
+var watchTokenCounter atomic.Uint64
+
+// newWatchToken returns a token for a watch which the library creates internally &
+// removes again when it is finished with, using the function given to WithWatchTokens
+// if there was one.
+func (c *Client) newWatchToken() string {
+	if c.opts.watchTokens != nil {
+		return c.opts.watchTokens()
+	}
+
+	return fmt.Sprintf("xenstore-go/%d/%d", os.Getpid(), watchTokenCounter.Add(1))
+}
+
+// WaitFor waits until predicate returns true for path, returning the value of path
+// at that point. predicate is called with the current value straight away and then
+// again each time path changes; exists is false (and value empty) while path does not
+// exist. If ctx is done before then its error is returned.
+//
+// A watch is set on path for the duration of the call and removed before returning.
+// XenStore fires every new watch once when it is set up, and may coalesce changes
+// which happen close together, so predicate should only depend on the value it is
+// given rather than on the number of times it is called.
+func (c *Client) WaitFor(ctx context.Context, path string, predicate func(value string, exists bool) bool) (string, error) {
+	token := c.newWatchToken()
+
+	ch, err := c.Watch(path, token)
+	if err != nil {
+		return "", err
+	}
+
+	w := &watchState{path: path}
+	value, err := c.waitFor(ctx, ch, w, predicate)
+
+	if unwatchErr := c.unwatchDraining(path, token, ch); unwatchErr != nil && err == nil {
+		return "", unwatchErr
+	}
+
+	return value, err
+}
+
+// watchState tracks the packets received by an internal watch.
+type watchState struct {
+	path string
+	// changed is set when path may have changed since it was last read.
+	changed bool
+	// err is set if the watch fails.
+	err error
+}
+
+// handle processes a packet received on the channel of the watch.
+func (w *watchState) handle(rsp *Packet, ok bool) {
+	switch {
+	case !ok:
+		w.err = ErrConnectionLost
+	case rsp.Header.Op == XsError:
+		w.err = &OpError{Op: XsWatch.String(), Path: w.path, Err: rsp.Check()}
+	case rsp.Header.Op == XsWatchEvent:
+		// Changes to descendants cannot affect the value of the path itself
+		if !strings.HasPrefix(rsp.Strings()[0], w.path+"/") {
+			w.changed = true
+		}
+	}
+}
+
+func (c *Client) waitFor(ctx context.Context, ch chan *Packet, w *watchState, predicate func(value string, exists bool) bool) (string, error) {
+	for {
+		// Read the current value, carrying on receiving events meanwhile
+		w.changed = false
+
+		p, replyCh, err := c.sendBytes(XsRead, append([]byte(w.path), NUL), 0x0)
+		if err != nil {
+			return "", err
+		}
+
+		rsp, err := c.awaitReply(ctx, p, replyCh, ch, w.handle)
+		if w.err != nil {
+			return "", w.err
+		}
+
+		var value string
+		switch {
+		case err == nil:
+			value = rsp.payloadString()
+		case !errors.Is(err, ErrNotFound):
+			return "", err
+		}
+
+		if predicate(value, err == nil) {
+			return value, nil
+		}
+
+		for !w.changed {
+			select {
+			case rsp, ok := <-ch:
+				w.handle(rsp, ok)
+				if w.err != nil {
+					return "", w.err
+				}
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+	}
+}
+
+// unwatchDraining removes a watch set up by the library, discarding any events which
+// arrive on ch until XenStore confirms the watch has gone.
+func (c *Client) unwatchDraining(path, token string, ch chan *Packet) error {
+	buf := bytes.NewBufferString(path)
+	buf.WriteByte(NUL)
+	buf.WriteString(token)
+	buf.WriteByte(NUL)
+
+	p, replyCh, err := c.sendBytes(XsUnWatch, buf.Bytes(), 0x0)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.awaitReply(context.Background(), p, replyCh, ch, func(*Packet, bool) {})
+	return err
+}
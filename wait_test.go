@@ -0,0 +1,83 @@
+package xenstore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/joelnb/xenstore-go/xenstoretest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientWaitFor(t *testing.T) {
+	store := xenstoretest.NewMemoryStore()
+	c := store.Client()
+	defer c.Close()
+
+	writer := store.Client()
+	defer writer.Close()
+
+	go func() {
+		for _, value := range []string{"1", "2", "3", "4"} {
+			time.Sleep(5 * time.Millisecond)
+			if _, err := writer.Write("/local/domain/5/device/vif/0/state", value); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	value, err := c.WaitFor(ctx, "/local/domain/5/device/vif/0/state", func(value string, exists bool) bool {
+		return exists && value == "4"
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "4", value)
+	}
+
+	assert.Zero(t, c.WatchCount())
+}
+
+func TestClientWaitForAlreadySatisfied(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	var calls int
+	value, err := c.WaitFor(context.Background(), "/local/domain/5/name", func(value string, exists bool) bool {
+		calls++
+		return !exists
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+	assert.Equal(t, 1, calls)
+}
+
+func TestClientWaitForTimeout(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := c.WaitFor(ctx, "/local/domain/5/name", func(value string, exists bool) bool {
+		return exists
+	})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Zero(t, c.WatchCount())
+}
+
+func TestClientWaitForConnectionLost(t *testing.T) {
+	c := xenstoretest.NewMemoryStore().Client()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Close()
+	}()
+
+	_, err := c.WaitFor(context.Background(), "/local/domain/5/name", func(value string, exists bool) bool {
+		return exists
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,435 @@
+package xenstoretest
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	xenstore "github.com/joelnb/xenstore-go"
+)
+
+// MemoryStore is an in-memory implementation of the parts of xenstored which are
+// used by the Client, allowing code which uses it to be tested without a Xen host.
+// Each call to Connect returns a new Transport connected to the same store, with its
+// own watches, so several clients can share the store. Committing a transaction fails
+// with xenstore.ErrTransactionConflict if the store changed while it was open.
+type MemoryStore struct {
+	lock         sync.Mutex
+	root         *memoryNode
+	generation   uint64
+	nextTx       uint32
+	transactions map[uint32]*memoryTransaction
+	conns        map[*memoryTransport]struct{}
+}
+
+type memoryNode struct {
+	value    string
+	perms    []string
+	children map[string]*memoryNode
+}
+
+type memoryTransaction struct {
+	root       *memoryNode
+	generation uint64
+	changes    []memoryChange
+}
+
+// memoryChange records a modified path & whether it was removed, which also affects
+// watches on its descendants.
+type memoryChange struct {
+	path    string
+	removed bool
+}
+
+// NewMemoryStore creates an empty MemoryStore. Like xenstored, the root node belongs
+// to dom0 & new nodes inherit the permissions of their parent.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		root:         newMemoryNode("", []string{"n0"}),
+		nextTx:       1,
+		transactions: map[uint32]*memoryTransaction{},
+		conns:        map[*memoryTransport]struct{}{},
+	}
+}
+
+func newMemoryNode(value string, perms []string) *memoryNode {
+	return &memoryNode{
+		value:    value,
+		perms:    append([]string{}, perms...),
+		children: map[string]*memoryNode{},
+	}
+}
+
+func (n *memoryNode) copy() *memoryNode {
+	c := newMemoryNode(n.value, n.perms)
+	for name, child := range n.children {
+		c.children[name] = child.copy()
+	}
+
+	return c
+}
+
+// Connect returns a new connection to the store.
+func (s *MemoryStore) Connect() xenstore.Transport {
+	return s.connect()
+}
+
+func (s *MemoryStore) connect() *memoryTransport {
+	t := &memoryTransport{
+		store:   s,
+		watches: map[memoryWatch]struct{}{},
+	}
+	t.cond = sync.NewCond(&t.lock)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.conns[t] = struct{}{}
+
+	return t
+}
+
+// Client returns a new Client connected to the store.
+func (s *MemoryStore) Client(opts ...xenstore.ClientOption) *xenstore.Client {
+	return xenstore.NewClient(s.connect(), opts...)
+}
+
+func splitMemoryPath(path string) []string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/local/domain/0/" + path
+	}
+
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return parts
+}
+
+func joinMemoryPath(parts []string) string {
+	return "/" + strings.Join(parts, "/")
+}
+
+func (s *MemoryStore) lookup(root *memoryNode, path string) *memoryNode {
+	node := root
+	for _, part := range splitMemoryPath(path) {
+		var ok bool
+		if node, ok = node.children[part]; !ok {
+			return nil
+		}
+	}
+
+	return node
+}
+
+// create returns the node at path, creating it and any missing parents with empty
+// values. Newly created nodes inherit the permissions of their parent.
+func (s *MemoryStore) create(root *memoryNode, path string) (*memoryNode, []memoryChange) {
+	var changes []memoryChange
+
+	parts := splitMemoryPath(path)
+	node := root
+	for i, part := range parts {
+		child, ok := node.children[part]
+		if !ok {
+			child = newMemoryNode("", node.perms)
+			node.children[part] = child
+			changes = append(changes, memoryChange{path: joinMemoryPath(parts[:i+1])})
+		}
+		node = child
+	}
+
+	return node, changes
+}
+
+// apply performs a single operation against the tree rooted at root.
+func (s *MemoryStore) apply(root *memoryNode, op xenstore.Operation, payload []byte) (string, []memoryChange, error) {
+	args := strings.Split(strings.TrimSuffix(string(payload), "\x00"), "\x00")
+
+	switch op {
+	case xenstore.XsRead:
+		node := s.lookup(root, args[0])
+		if node == nil {
+			return "", nil, syscall.ENOENT
+		}
+		return node.value, nil, nil
+
+	case xenstore.XsDirectory:
+		node := s.lookup(root, args[0])
+		if node == nil {
+			return "", nil, syscall.ENOENT
+		}
+
+		names := []string{}
+		for name := range node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var buf bytes.Buffer
+		for _, name := range names {
+			buf.WriteString(name)
+			buf.WriteByte(xenstore.NUL)
+		}
+		return buf.String(), nil, nil
+
+	case xenstore.XsGetPermissions:
+		node := s.lookup(root, args[0])
+		if node == nil {
+			return "", nil, syscall.ENOENT
+		}
+		return strings.Join(node.perms, "\x00") + "\x00", nil, nil
+
+	case xenstore.XsWrite:
+		i := bytes.IndexByte(payload, xenstore.NUL)
+		if i < 0 {
+			return "", nil, syscall.EINVAL
+		}
+
+		node, changes := s.create(root, string(payload[:i]))
+		node.value = string(payload[i+1:])
+		if len(changes) == 0 {
+			changes = append(changes, memoryChange{path: joinMemoryPath(splitMemoryPath(string(payload[:i])))})
+		}
+		return "OK\x00", changes, nil
+
+	case xenstore.XsMkdir:
+		_, changes := s.create(root, args[0])
+		return "OK\x00", changes, nil
+
+	case xenstore.XsRm:
+		parts := splitMemoryPath(args[0])
+		if len(parts) == 0 {
+			return "", nil, syscall.EINVAL
+		}
+
+		parent := s.lookup(root, joinMemoryPath(parts[:len(parts)-1]))
+		if parent == nil {
+			return "", nil, syscall.ENOENT
+		}
+		if _, ok := parent.children[parts[len(parts)-1]]; !ok {
+			return "", nil, syscall.ENOENT
+		}
+
+		delete(parent.children, parts[len(parts)-1])
+		return "OK\x00", []memoryChange{{path: joinMemoryPath(parts), removed: true}}, nil
+
+	case xenstore.XsSetPermissions:
+		node := s.lookup(root, args[0])
+		if node == nil {
+			return "", nil, syscall.ENOENT
+		}
+		if len(args) < 2 || !xenstore.ValidPermissions(args[1:]...) {
+			return "", nil, syscall.EINVAL
+		}
+
+		node.perms = append([]string{}, args[1:]...)
+		return "OK\x00", []memoryChange{{path: joinMemoryPath(splitMemoryPath(args[0]))}}, nil
+
+	case xenstore.XsGetDomainPath:
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			return "", nil, syscall.EINVAL
+		}
+		return "/local/domain/" + args[0] + "\x00", nil, nil
+	}
+
+	return "", nil, syscall.ENOSYS
+}
+
+// handle processes a request sent over conn and returns the reply, or nil if the
+// reply has already been queued.
+func (s *MemoryStore) handle(conn *memoryTransport, req *xenstore.Packet) *xenstore.Packet {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rsp := &xenstore.Packet{
+		Header: &xenstore.PacketHeader{
+			Op:   req.Header.Op,
+			RqId: req.Header.RqId,
+			TxId: req.Header.TxId,
+		},
+	}
+
+	reply := func(payload string, err error) *xenstore.Packet {
+		if err != nil {
+			rsp.Header.Op = xenstore.XsError
+			payload = xenstore.ErrorName(err) + "\x00"
+		}
+
+		rsp.Payload = []byte(payload)
+		rsp.Header.Length = uint32(len(rsp.Payload))
+		return rsp
+	}
+
+	args := strings.Split(strings.TrimSuffix(string(req.Payload), "\x00"), "\x00")
+
+	switch req.Header.Op {
+	case xenstore.XsWatch:
+		// Like xenstored the watch fires once straight after the acknowledgement
+		conn.watches[memoryWatch{path: args[0], token: args[1]}] = struct{}{}
+		conn.push(reply("OK\x00", nil))
+		conn.queueEvent(args[0], args[1])
+		return nil
+
+	case xenstore.XsUnWatch:
+		watch := memoryWatch{path: args[0], token: args[1]}
+		if _, ok := conn.watches[watch]; !ok {
+			return reply("", syscall.ENOENT)
+		}
+		delete(conn.watches, watch)
+		return reply("OK\x00", nil)
+
+	case xenstore.XsStartTransaction:
+		id := s.nextTx
+		s.nextTx++
+		s.transactions[id] = &memoryTransaction{root: s.root.copy(), generation: s.generation}
+		return reply(strconv.Itoa(int(id))+"\x00", nil)
+
+	case xenstore.XsEndTransaction:
+		tx, ok := s.transactions[req.Header.TxId]
+		if !ok {
+			return reply("", syscall.ENOENT)
+		}
+		delete(s.transactions, req.Header.TxId)
+
+		if args[0] != "T" {
+			return reply("OK\x00", nil)
+		}
+		if tx.generation != s.generation {
+			return reply("", syscall.EAGAIN)
+		}
+
+		s.root = tx.root
+		s.commit(tx.changes)
+		return reply("OK\x00", nil)
+	}
+
+	if req.Header.TxId != 0 {
+		tx, ok := s.transactions[req.Header.TxId]
+		if !ok {
+			return reply("", syscall.ENOENT)
+		}
+
+		payload, changes, err := s.apply(tx.root, req.Header.Op, req.Payload)
+		tx.changes = append(tx.changes, changes...)
+		return reply(payload, err)
+	}
+
+	payload, changes, err := s.apply(s.root, req.Header.Op, req.Payload)
+	s.commit(changes)
+	return reply(payload, err)
+}
+
+// commit records that the tree has changed & fires any matching watches. The caller
+// must hold s.lock.
+func (s *MemoryStore) commit(changes []memoryChange) {
+	if len(changes) == 0 {
+		return
+	}
+
+	s.generation++
+
+	for conn := range s.conns {
+		for watch := range conn.watches {
+			for _, change := range changes {
+				if change.path == watch.path ||
+					strings.HasPrefix(change.path, watch.path+"/") ||
+					watch.path == "/" {
+					conn.queueEvent(change.path, watch.token)
+				} else if change.removed && strings.HasPrefix(watch.path, change.path+"/") {
+					// Like xenstored, removing a parent reports the watched path
+					conn.queueEvent(watch.path, watch.token)
+				}
+			}
+		}
+	}
+}
+
+// memoryWatch identifies a watch, which like xenstored is by its path & token together.
+type memoryWatch struct {
+	path  string
+	token string
+}
+
+// memoryTransport is a single connection to a MemoryStore.
+type memoryTransport struct {
+	store   *MemoryStore
+	watches map[memoryWatch]struct{}
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	queue  []*xenstore.Packet
+	closed bool
+}
+
+func (t *memoryTransport) push(p *xenstore.Packet) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.queue = append(t.queue, p)
+	t.cond.Signal()
+}
+
+func (t *memoryTransport) queueEvent(path, token string) {
+	payload := []byte(path + "\x00" + token + "\x00")
+
+	t.push(&xenstore.Packet{
+		Header: &xenstore.PacketHeader{
+			Op:     xenstore.XsWatchEvent,
+			Length: uint32(len(payload)),
+		},
+		Payload: payload,
+	})
+}
+
+func (t *memoryTransport) Send(p *xenstore.Packet) error {
+	t.lock.Lock()
+	closed := t.closed
+	t.lock.Unlock()
+
+	if closed {
+		return &os.PathError{Op: "write", Path: "memory", Err: os.ErrClosed}
+	}
+
+	if rsp := t.store.handle(t, p); rsp != nil {
+		t.push(rsp)
+	}
+	return nil
+}
+
+func (t *memoryTransport) Receive() (*xenstore.Packet, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for len(t.queue) == 0 && !t.closed {
+		t.cond.Wait()
+	}
+
+	if t.closed {
+		return nil, &os.PathError{Op: "read", Path: "memory", Err: os.ErrClosed}
+	}
+
+	p := t.queue[0]
+	t.queue = t.queue[1:]
+	return p, nil
+}
+
+func (t *memoryTransport) Close() error {
+	t.store.lock.Lock()
+	delete(t.store.conns, t)
+	t.store.lock.Unlock()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+	t.cond.Broadcast()
+	return nil
+}
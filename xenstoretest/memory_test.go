@@ -0,0 +1,44 @@
+package xenstoretest
+
+import (
+	"testing"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+
+	c := store.Client()
+	defer c.Close()
+
+	other := store.Client()
+	defer other.Close()
+
+	_, err := c.Write("/local/domain/1/name", "new")
+	assert.NoError(t, err)
+
+	ch, err := other.Watch("/local/domain/1", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/local/domain/1", nextEvent(t, ch))
+
+	_, err = c.Write("/local/domain/1/name", "guest")
+	assert.NoError(t, err)
+	assert.Equal(t, "/local/domain/1/name", nextEvent(t, ch))
+
+	value, err := other.Read("/local/domain/1/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "guest", value)
+
+	children, err := other.List("/local/domain/1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"name"}, children)
+
+	_, err = c.Read("/missing")
+	assert.ErrorIs(t, err, xenstore.ErrNotFound)
+
+	assert.NoError(t, other.UnWatch("/local/domain/1", "token"))
+}
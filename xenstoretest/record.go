@@ -0,0 +1,169 @@
+package xenstoretest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	xenstore "github.com/joelnb/xenstore-go"
+)
+
+// Recorder is a xenstore.Transport which wraps another, such as a connection to a
+// real XenStore, capturing every Packet sent or received so that the conversation can
+// be saved & later replayed using NewReplayTransport. Recordings use the capture
+// format of xenstore.TapTransport, so the file written by the --capture flag of the
+// xenstore command can be replayed too, & recordings can be printed with its decode
+// command.
+type Recorder struct {
+	*xenstore.TapTransport
+
+	capture *captureBuffer
+}
+
+// captureBuffer holds a capture in memory while it is being written.
+type captureBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *captureBuffer) Bytes() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+// NewRecorder creates a Recorder which sends Packets using t.
+func NewRecorder(t xenstore.Transport) *Recorder {
+	capture := &captureBuffer{}
+
+	// Writing to memory cannot fail
+	cw, _ := xenstore.NewCaptureWriter(capture)
+
+	return &Recorder{
+		TapTransport: xenstore.NewTapTransport(t, cw),
+		capture:      capture,
+	}
+}
+
+// Records returns the Packets recorded so far.
+func (r *Recorder) Records() []*xenstore.CaptureRecord {
+	records, _ := xenstore.ReadCapture(bytes.NewReader(r.capture.Bytes()))
+	return records
+}
+
+// WriteTo writes the Packets recorded so far to w as a capture.
+func (r *Recorder) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r.capture.Bytes())
+	return int64(n), err
+}
+
+// Save writes the Packets recorded so far to the file at path, replacing it.
+func (r *Recorder) Save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// LoadRecording reads the records saved to the file at path by Recorder.Save or by
+// the --capture flag of the xenstore command.
+func LoadRecording(path string) ([]*xenstore.CaptureRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return xenstore.ReadCapture(f)
+}
+
+// NewReplayTransport creates a ScriptedTransport which expects exactly the requests
+// in records, with the same payloads & in the same order, & replies as XenStore did
+// when they were recorded. Each reply is sent as soon as the request it answers is
+// received, so the replay does not depend on the timing of the original conversation.
+// Watch events are sent after the replies to the request which preceded them.
+//
+// RFC 3339 timestamps in requests, such as the expiry written by a xenstore.Lock,
+// match any other timestamp. The tokens of the watches set up by WaitFor, NewMirror &
+// Lock only match if both clients were created with the same
+// xenstore.WithWatchTokens.
+func NewReplayTransport(tb testing.TB, records []*xenstore.CaptureRecord) (*ScriptedTransport, error) {
+	var steps []*step
+	var initial []*xenstore.Packet
+
+	// The most recent request with each ID, which the replies are attached to
+	requests := map[uint32]*step{}
+
+	for i, rec := range records {
+		p := rec.Packet
+
+		if rec.Direction == xenstore.CaptureSent {
+			st := &step{op: p.Header.Op, payload: p.Payload, anyTime: true}
+			steps = append(steps, st)
+			requests[p.Header.RqId] = st
+			continue
+		}
+
+		var target *step
+		if p.Header.Op == xenstore.XsWatchEvent {
+			if len(steps) == 0 {
+				// A watch event received before any request was sent
+				initial = append(initial, p)
+				continue
+			}
+			target = steps[len(steps)-1]
+		} else if target = requests[p.Header.RqId]; target == nil {
+			return nil, fmt.Errorf("record %d: reply to unknown request %d", i, p.Header.RqId)
+		}
+
+		target.responses = append(target.responses, p)
+	}
+
+	s := NewScriptedTransport(tb)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.steps = steps
+	for _, p := range initial {
+		s.push(p)
+	}
+
+	return s, nil
+}
+
+// ReplayFile creates a ScriptedTransport replaying the records saved to the file at
+// path, failing the test if it cannot be loaded.
+func ReplayFile(tb testing.TB, path string) *ScriptedTransport {
+	tb.Helper()
+
+	records, err := LoadRecording(path)
+	if err != nil {
+		tb.Fatalf("xenstoretest: loading recording: %s", err)
+	}
+
+	s, err := NewReplayTransport(tb, records)
+	if err != nil {
+		tb.Fatalf("xenstoretest: replaying %s: %s", path, err)
+	}
+
+	return s
+}
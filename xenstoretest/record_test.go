@@ -0,0 +1,220 @@
+package xenstoretest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// exercise uses c as code under test would, returning what it read.
+func exercise(t *testing.T, c *xenstore.Client) []string {
+	t.Helper()
+
+	var results []string
+
+	value, err := c.Read("/local/domain/1/name")
+	assert.NoError(t, err)
+	results = append(results, value)
+
+	children, err := c.List("/local/domain/1")
+	assert.NoError(t, err)
+	results = append(results, children...)
+
+	_, err = c.Read("/missing")
+	results = append(results, xenstore.ErrorName(err))
+
+	ch, err := c.Watch("/vm/1", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results = append(results, nextEvent(t, ch))
+	assert.NoError(t, c.UnWatch("/vm/1", "token"))
+
+	return results
+}
+
+func TestRecordReplay(t *testing.T) {
+	// Stands in for a real XenStore
+	backend := NewScriptedTransport(t)
+	backend.Expect(xenstore.XsRead, "/local/domain/1/name").Respond("guest")
+	backend.Expect(xenstore.XsDirectory, "/local/domain/1").Respond("name", "data")
+	backend.Expect(xenstore.XsRead, "/missing").RespondError(xenstore.ErrNotFound)
+	backend.Expect(xenstore.XsWatch, "/vm/1", "token").Respond("OK").WatchEvent("/vm/1", "token")
+	backend.Expect(xenstore.XsUnWatch, "/vm/1", "token").Respond("OK")
+
+	recorder := NewRecorder(backend)
+	c := xenstore.NewClient(recorder)
+	recorded := exercise(t, c)
+	c.Close()
+
+	assert.Equal(t, []string{"guest", "name", "data", "ENOENT", "/vm/1"}, recorded)
+	assert.Len(t, recorder.Records(), 11)
+
+	path := filepath.Join(t.TempDir(), "recording")
+	if err := recorder.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := ReplayFile(t, path)
+	c = xenstore.NewClient(replay, xenstore.WithWatchTokens(countingTokens()))
+	defer c.Close()
+
+	assert.Equal(t, recorded, exercise(t, c))
+	assert.Equal(t, 0, replay.Remaining())
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	backend := NewScriptedTransport(t)
+	backend.Expect(xenstore.XsWrite, "/binary", "\xff\xfe").Respond("OK")
+
+	recorder := NewRecorder(backend)
+	c := xenstore.NewClient(recorder)
+	_, err := c.Write("/binary", "\xff\xfe")
+	assert.NoError(t, err)
+	c.Close()
+
+	var buf bytes.Buffer
+	n, err := recorder.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	records, err := xenstore.ReadCapture(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, recorder.Records(), records)
+
+	p := records[0].Packet
+	assert.Equal(t, xenstore.CaptureSent, records[0].Direction)
+	assert.Equal(t, xenstore.XsWrite, p.Header.Op)
+	assert.Equal(t, []string{"/binary", "\xff\xfe"}, p.Strings())
+}
+
+func TestReplayCapture(t *testing.T) {
+	// A capture written by a TapTransport, as by the --capture flag of the xenstore
+	// command, replays just like a recording
+	path := filepath.Join(t.TempDir(), "capture")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cw, err := xenstore.NewCaptureWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryStore()
+	if _, err := store.Client().Write("/local/domain/1/name", "guest"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := xenstore.NewClient(xenstore.NewTapTransport(store.Connect(), cw))
+	value, err := c.Read("/local/domain/1/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "guest", value)
+	c.Close()
+	assert.NoError(t, f.Close())
+
+	replay := ReplayFile(t, path)
+	c = xenstore.NewClient(replay)
+	defer c.Close()
+
+	value, err = c.Read("/local/domain/1/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "guest", value)
+	assert.Equal(t, 0, replay.Remaining())
+}
+
+func TestLoadRecordingInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording")
+	if err := os.WriteFile(path, []byte(`{"dir":"send","op":"read"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadRecording(path)
+	assert.ErrorIs(t, err, xenstore.ErrBadCapture)
+}
+
+func TestNewReplayTransportUnknownRequest(t *testing.T) {
+	_, err := NewReplayTransport(t, []*xenstore.CaptureRecord{{
+		Direction: xenstore.CaptureReceived,
+		Packet:    &xenstore.Packet{Header: &xenstore.PacketHeader{Op: xenstore.XsRead, RqId: 5}},
+	}})
+	assert.Error(t, err)
+}
+
+// countingTokens returns a deterministic source of watch tokens for
+// xenstore.WithWatchTokens.
+func countingTokens() func() string {
+	n := 0
+	return func() string {
+		n++
+		return fmt.Sprintf("token-%d", n)
+	}
+}
+
+// recordAndReplay runs use against a MemoryStore through a Recorder, then again
+// against a replay of the recording, checking both return the same & the replay
+// expected every request.
+func recordAndReplay(t *testing.T, store *MemoryStore, use func(c *xenstore.Client, live bool) string) {
+	t.Helper()
+
+	recorder := NewRecorder(store.Connect())
+	c := xenstore.NewClient(recorder, xenstore.WithWatchTokens(countingTokens()))
+	recorded := use(c, true)
+	c.Close()
+
+	replay, err := NewReplayTransport(t, recorder.Records())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = xenstore.NewClient(replay, xenstore.WithWatchTokens(countingTokens()))
+	defer c.Close()
+
+	assert.Equal(t, recorded, use(c, false))
+	assert.Equal(t, 0, replay.Remaining())
+}
+
+func TestReplayWaitFor(t *testing.T) {
+	store := NewMemoryStore()
+
+	writer := store.Client()
+	defer writer.Close()
+
+	if _, err := writer.Write("/local/domain/1/device/state", "initialising"); err != nil {
+		t.Fatal(err)
+	}
+
+	recordAndReplay(t, store, func(c *xenstore.Client, live bool) string {
+		value, err := c.WaitFor(context.Background(), "/local/domain/1/device/state", func(value string, exists bool) bool {
+			if value == "initialising" && live {
+				// The device connects once the wait has started
+				go writer.Write("/local/domain/1/device/state", "connected")
+			}
+
+			return value == "connected"
+		})
+		assert.NoError(t, err)
+
+		return value
+	})
+}
+
+func TestReplayLock(t *testing.T) {
+	recordAndReplay(t, NewMemoryStore(), func(c *xenstore.Client, live bool) string {
+		l := xenstore.NewLock(c, "/tool/test/lock", xenstore.WithLockOwner("test"))
+		assert.NoError(t, l.Lock(context.Background()))
+
+		holder, err := l.Holder()
+		assert.NoError(t, err)
+		assert.NoError(t, l.Unlock())
+
+		return holder
+	})
+}
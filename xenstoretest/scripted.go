@@ -0,0 +1,329 @@
+// Package xenstoretest provides Transports for testing code which uses a
+// xenstore.Client without a real XenStore: a ScriptedTransport which checks each
+// request against a script of expectations & replies as scripted, and a Recorder
+// which captures the Packets exchanged with a real XenStore so that they can be
+// replayed later.
+package xenstoretest
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	xenstore "github.com/joelnb/xenstore-go"
+)
+
+// step is a single request expected by a ScriptedTransport.
+type step struct {
+	op xenstore.Operation
+	// payload is the exact payload expected, used in preference to args if not nil.
+	payload []byte
+	// anyTime allows strings of payload which are RFC 3339 timestamps, such as the
+	// expiry of a xenstore.Lock, to match any other timestamp.
+	anyTime bool
+	// args are the expected strings of the payload, or nil to accept any payload.
+	args []string
+	// responses are sent when the request is received. Replies have their request ID
+	// replaced with that of the request.
+	responses []*xenstore.Packet
+}
+
+func (s *step) matches(p *xenstore.Packet) bool {
+	if p.Header.Op != s.op {
+		return false
+	}
+
+	if s.payload != nil {
+		if bytes.Equal(p.Payload, s.payload) {
+			return true
+		}
+
+		return s.anyTime && matchTimes(splitPayload(s.payload), splitPayload(p.Payload))
+	}
+
+	if s.args == nil {
+		return true
+	}
+
+	got := p.Strings()
+	if len(got) != len(s.args) {
+		return false
+	}
+
+	for i := range got {
+		if got[i] != s.args[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchTimes reports whether got differs from expected only in the times given by
+// RFC 3339 timestamps.
+func matchTimes(expected, got []string) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+
+	for i := range got {
+		if got[i] != expected[i] && !(isTimestamp(got[i]) && isTimestamp(expected[i])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isTimestamp(s string) bool {
+	_, err := time.Parse(time.RFC3339Nano, s)
+	return err == nil
+}
+
+func (s *step) String() string {
+	if s.payload != nil {
+		return s.op.String() + " " + strings.Join(splitPayload(s.payload), " ")
+	}
+
+	if s.args == nil {
+		return s.op.String() + " (any payload)"
+	}
+
+	return s.op.String() + " " + strings.Join(s.args, " ")
+}
+
+// ScriptedTransport is a xenstore.Transport which expects a scripted sequence of
+// requests, replying to each of them with the scripted responses. Requests which do
+// not match the next expectation are reported as test failures & answered with
+// xenstore.ErrInvalid. Any expectations which have not been met when the test ends are
+// reported too.
+type ScriptedTransport struct {
+	tb testing.TB
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	steps  []*step
+	next   int
+	queue  []*xenstore.Packet
+	closed bool
+}
+
+// NewScriptedTransport creates a ScriptedTransport which reports failures to tb.
+func NewScriptedTransport(tb testing.TB) *ScriptedTransport {
+	s := &ScriptedTransport{tb: tb}
+	s.cond = sync.NewCond(&s.lock)
+
+	tb.Cleanup(func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if s.next < len(s.steps) {
+			tb.Errorf("xenstoretest: %d expected requests were not sent, starting with %s",
+				len(s.steps)-s.next, s.steps[s.next])
+		}
+	})
+
+	return s
+}
+
+// Expectation is a single request expected by a ScriptedTransport. Its methods add the
+// responses which are sent, in order, when the request is received.
+type Expectation struct {
+	transport *ScriptedTransport
+	step      *step
+}
+
+// Expect adds a request for op to the script, with a payload made up of args, such
+// as the path & value for xenstore.XsWrite. Passing no args accepts any payload.
+func (s *ScriptedTransport) Expect(op xenstore.Operation, args ...string) *Expectation {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := &step{op: op}
+	if len(args) > 0 {
+		st.args = args
+	}
+
+	return s.add(st)
+}
+
+// add appends st to the script. The caller must hold s.lock.
+func (s *ScriptedTransport) add(st *step) *Expectation {
+	s.steps = append(s.steps, st)
+
+	return &Expectation{transport: s, step: st}
+}
+
+// Respond replies to the request with a payload made up of args, e.g. the value for
+// xenstore.XsRead or the names of the children for xenstore.XsDirectory.
+func (e *Expectation) Respond(args ...string) *Expectation {
+	return e.RespondPacket(newPacket(e.step.op, 0, joinPayload(args)))
+}
+
+// RespondError replies to the request with err, which should be one of the errors
+// returned by XenStore such as xenstore.ErrNotFound.
+func (e *Expectation) RespondError(err error) *Expectation {
+	name := xenstore.ErrorName(err)
+	if name == "" {
+		name = err.Error()
+	}
+
+	return e.RespondPacket(newPacket(xenstore.XsError, 0, []byte(name+"\x00")))
+}
+
+// RespondPacket replies to the request with p. The request ID of p is replaced with
+// that of the request unless p is a watch event.
+func (e *Expectation) RespondPacket(p *xenstore.Packet) *Expectation {
+	return e.addResponse(copyPacket(p))
+}
+
+// WatchEvent sends a watch event for path & token after the responses added so far.
+func (e *Expectation) WatchEvent(path, token string) *Expectation {
+	return e.addResponse(newWatchEvent(path, token))
+}
+
+func (e *Expectation) addResponse(p *xenstore.Packet) *Expectation {
+	e.transport.lock.Lock()
+	defer e.transport.lock.Unlock()
+
+	e.step.responses = append(e.step.responses, p)
+	return e
+}
+
+// WatchEvent sends a watch event for path & token straight away, without waiting for a
+// request.
+func (s *ScriptedTransport) WatchEvent(path, token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.push(newWatchEvent(path, token))
+}
+
+// Remaining returns the number of expected requests which have not been sent yet.
+func (s *ScriptedTransport) Remaining() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.steps) - s.next
+}
+
+// Send checks p against the next expected request & queues the responses.
+func (s *ScriptedTransport) Send(p *xenstore.Packet) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return &os.PathError{Op: "write", Path: "xenstoretest", Err: os.ErrClosed}
+	}
+
+	if s.next >= len(s.steps) {
+		s.tb.Errorf("xenstoretest: unexpected request %s", p)
+		s.reject(p)
+		return nil
+	}
+
+	st := s.steps[s.next]
+	if !st.matches(p) {
+		s.tb.Errorf("xenstoretest: expected request %s but got %s", st, p)
+		s.reject(p)
+		return nil
+	}
+	s.next++
+
+	for _, rsp := range st.responses {
+		reply := copyPacket(rsp)
+		if reply.Header.Op != xenstore.XsWatchEvent {
+			reply.Header.RqId = p.Header.RqId
+		}
+
+		s.push(reply)
+	}
+
+	return nil
+}
+
+// reject answers a request which was not expected so that the caller does not wait
+// for a reply forever.
+func (s *ScriptedTransport) reject(p *xenstore.Packet) {
+	reply := newPacket(xenstore.XsError, p.Header.TxId, []byte(xenstore.ErrorName(xenstore.ErrInvalid)+"\x00"))
+	reply.Header.RqId = p.Header.RqId
+
+	s.push(reply)
+}
+
+// push queues p to be returned by Receive. The caller must hold s.lock.
+func (s *ScriptedTransport) push(p *xenstore.Packet) {
+	s.queue = append(s.queue, p)
+	s.cond.Signal()
+}
+
+// Receive returns the next queued response, waiting until there is one.
+func (s *ScriptedTransport) Receive() (*xenstore.Packet, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+
+	if s.closed {
+		return nil, &os.PathError{Op: "read", Path: "xenstoretest", Err: os.ErrClosed}
+	}
+
+	p := s.queue[0]
+	s.queue = s.queue[1:]
+	return p, nil
+}
+
+// Close stops the Transport, causing any call to Receive to fail.
+func (s *ScriptedTransport) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
+
+func newPacket(op xenstore.Operation, txid uint32, payload []byte) *xenstore.Packet {
+	return &xenstore.Packet{
+		Header: &xenstore.PacketHeader{
+			Op:     op,
+			TxId:   txid,
+			Length: uint32(len(payload)),
+		},
+		Payload: payload,
+	}
+}
+
+func newWatchEvent(path, token string) *xenstore.Packet {
+	return newPacket(xenstore.XsWatchEvent, 0, joinPayload([]string{path, token}))
+}
+
+func copyPacket(p *xenstore.Packet) *xenstore.Packet {
+	header := *p.Header
+
+	return &xenstore.Packet{
+		Header:  &header,
+		Payload: append([]byte{}, p.Payload...),
+	}
+}
+
+// splitPayload splits a payload into its NUL terminated strings, as Packet.Strings.
+func splitPayload(payload []byte) []string {
+	return strings.Split(strings.Trim(string(payload), "\x00"), "\x00")
+}
+
+// joinPayload builds a payload from NUL terminated strings.
+func joinPayload(args []string) []byte {
+	var b strings.Builder
+	for _, arg := range args {
+		b.WriteString(arg)
+		b.WriteByte(xenstore.NUL)
+	}
+
+	return []byte(b.String())
+}
@@ -0,0 +1,118 @@
+package xenstoretest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	xenstore "github.com/joelnb/xenstore-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTB captures the failures reported to it rather than failing the test.
+type recordingTB struct {
+	*testing.T
+
+	errors []string
+}
+
+func (tb *recordingTB) Errorf(format string, args ...interface{}) {
+	tb.errors = append(tb.errors, fmt.Sprintf(format, args...))
+}
+
+// nextEvent waits for the next watch event on ch, skipping the acknowledgement of the
+// watch, & returns its path.
+func nextEvent(t *testing.T, ch chan *xenstore.Packet) string {
+	t.Helper()
+
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				t.Fatal("watch channel closed")
+			}
+
+			if p.Header.Op == xenstore.XsWatchEvent {
+				return p.Strings()[0]
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a watch event")
+		}
+	}
+}
+
+func TestScriptedTransport(t *testing.T) {
+	s := NewScriptedTransport(t)
+	s.Expect(xenstore.XsRead, "/local/domain/1/name").Respond("guest")
+	s.Expect(xenstore.XsWrite, "/local/domain/1/name", "renamed").Respond("OK")
+	s.Expect(xenstore.XsRead, "/missing").RespondError(xenstore.ErrNotFound)
+	s.Expect(xenstore.XsWatch, "/vm/1", "token").
+		Respond("OK").
+		WatchEvent("/vm/1", "token")
+	s.Expect(xenstore.XsUnWatch).Respond("OK")
+
+	c := xenstore.NewClient(s)
+	defer c.Close()
+
+	value, err := c.Read("/local/domain/1/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "guest", value)
+
+	_, err = c.Write("/local/domain/1/name", "renamed")
+	assert.NoError(t, err)
+
+	_, err = c.Read("/missing")
+	assert.True(t, errors.Is(err, xenstore.ErrNotFound))
+
+	ch, err := c.Watch("/vm/1", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/vm/1", nextEvent(t, ch))
+
+	s.WatchEvent("/vm/1/name", "token")
+	assert.Equal(t, "/vm/1/name", nextEvent(t, ch))
+
+	assert.NoError(t, c.UnWatch("/vm/1", "token"))
+	assert.Equal(t, 0, s.Remaining())
+}
+
+func TestScriptedTransportTransaction(t *testing.T) {
+	s := NewScriptedTransport(t)
+	s.Expect(xenstore.XsStartTransaction).Respond("7")
+	s.Expect(xenstore.XsWrite, "/test", "value").RespondPacket(&xenstore.Packet{
+		Header:  &xenstore.PacketHeader{Op: xenstore.XsWrite, TxId: 7, Length: 3},
+		Payload: []byte("OK\x00"),
+	})
+	s.Expect(xenstore.XsEndTransaction, "T").Respond("OK")
+
+	c := xenstore.NewClient(s)
+	defer c.Close()
+
+	assert.NoError(t, c.Transact(func(tx *xenstore.Transaction) error {
+		_, err := tx.Write("/test", "value")
+		return err
+	}))
+}
+
+func TestScriptedTransportUnexpected(t *testing.T) {
+	tb := &recordingTB{T: t}
+
+	s := NewScriptedTransport(tb)
+	s.Expect(xenstore.XsRead, "/expected").Respond("value")
+
+	c := xenstore.NewClient(s)
+	defer c.Close()
+
+	_, err := c.Read("/other")
+	assert.True(t, errors.Is(err, xenstore.ErrInvalid))
+	assert.Len(t, tb.errors, 1)
+
+	_, err = c.Read("/expected")
+	assert.NoError(t, err)
+
+	_, err = c.Read("/expected")
+	assert.True(t, errors.Is(err, xenstore.ErrInvalid))
+	assert.Len(t, tb.errors, 2)
+}